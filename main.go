@@ -163,6 +163,286 @@ func main() {
 			Usage:  "URL for stable repository (default 'https://kubernetes-charts.storage.googleapis.com')",
 			EnvVar: "PLUGIN_STABLE_REPO_URL,STABLE_REPO_URL",
 		},
+		cli.BoolFlag{
+			Name:   "tls",
+			Usage:  "enable TLS for requests to Tiller",
+			EnvVar: "PLUGIN_TLS,TLS",
+		},
+		cli.BoolFlag{
+			Name:   "tls-verify",
+			Usage:  "enable TLS for requests to Tiller and verify the remote",
+			EnvVar: "PLUGIN_TLS_VERIFY,TLS_VERIFY",
+		},
+		cli.StringFlag{
+			Name:   "tls-ca-cert",
+			Usage:  "CA certificate used to verify Tiller (default <prefix>_TLS_CA_CERT secret)",
+			EnvVar: "PLUGIN_TLS_CA_CERT",
+		},
+		cli.StringFlag{
+			Name:   "tls-cert",
+			Usage:  "client certificate used to talk to Tiller (default <prefix>_TLS_CERT secret)",
+			EnvVar: "PLUGIN_TLS_CERT",
+		},
+		cli.StringFlag{
+			Name:   "tls-key",
+			Usage:  "client key used to talk to Tiller (default <prefix>_TLS_KEY secret)",
+			EnvVar: "PLUGIN_TLS_KEY",
+		},
+		cli.StringFlag{
+			Name:   "tiller-tls-cert",
+			Usage:  "server certificate to install Tiller with (default <prefix>_TILLER_TLS_CERT secret)",
+			EnvVar: "PLUGIN_TILLER_TLS_CERT",
+		},
+		cli.StringFlag{
+			Name:   "tiller-tls-key",
+			Usage:  "server key to install Tiller with (default <prefix>_TILLER_TLS_KEY secret)",
+			EnvVar: "PLUGIN_TILLER_TLS_KEY",
+		},
+		cli.StringFlag{
+			Name:   "tiller-service-account",
+			Usage:  "service account to create and install Tiller with",
+			EnvVar: "PLUGIN_TILLER_SERVICE_ACCOUNT,TILLER_SERVICE_ACCOUNT",
+		},
+		cli.StringSliceFlag{
+			Name:   "tiller-namespaces",
+			Usage:  "namespaces Tiller's service account can manage (default the release namespace)",
+			EnvVar: "PLUGIN_TILLER_NAMESPACES,TILLER_NAMESPACES",
+		},
+		cli.BoolFlag{
+			Name:   "tiller-cluster-admin",
+			Usage:  "if set, Tiller's service account is bound to cluster-admin",
+			EnvVar: "PLUGIN_TILLER_CLUSTER_ADMIN,TILLER_CLUSTER_ADMIN",
+		},
+		cli.StringFlag{
+			Name:   "history-max",
+			Usage:  "limit the maximum number of revisions saved per release",
+			EnvVar: "PLUGIN_HISTORY_MAX,HISTORY_MAX",
+		},
+		cli.StringSliceFlag{
+			Name:   "repo-insecure-skip-tls-verify",
+			Usage:  "helm_repos whose certificate should not be verified",
+			EnvVar: "PLUGIN_REPO_INSECURE_SKIP_TLS_VERIFY,REPO_INSECURE_SKIP_TLS_VERIFY",
+		},
+		cli.StringFlag{
+			Name:   "chart-cache",
+			Usage:  "folder charts pulled from OCI registries are kept in (default $HELM_HOME/cache/oci)",
+			EnvVar: "PLUGIN_CHART_CACHE,CHART_CACHE",
+		},
+		cli.BoolFlag{
+			Name:   "registry-plain-http",
+			Usage:  "if set, OCI registries are accessed over plain http",
+			EnvVar: "PLUGIN_REGISTRY_PLAIN_HTTP,REGISTRY_PLAIN_HTTP",
+		},
+		cli.StringFlag{
+			Name:   "package-dir",
+			Usage:  "folder the chart is packaged into (default the workspace)",
+			EnvVar: "PLUGIN_PACKAGE_DIR,PACKAGE_DIR",
+		},
+		cli.StringFlag{
+			Name:   "app-version",
+			Usage:  "set the appVersion on the packaged chart",
+			EnvVar: "PLUGIN_APP_VERSION,APP_VERSION",
+		},
+		cli.StringFlag{
+			Name:   "sign-key",
+			Usage:  "name of the key to sign the packaged chart with, read from the SIGN_KEYRING secret",
+			EnvVar: "PLUGIN_SIGN_KEY,SIGN_KEY",
+		},
+		cli.StringFlag{
+			Name:   "push-repo",
+			Usage:  "name of the helm_repos entry the packaged chart is pushed to",
+			EnvVar: "PLUGIN_PUSH_REPO,PUSH_REPO",
+		},
+		cli.BoolFlag{
+			Name:   "auto-version",
+			Usage:  "if set, the chart version and appVersion are derived from the drone tag, build number and commit",
+			EnvVar: "PLUGIN_AUTO_VERSION,AUTO_VERSION",
+		},
+		cli.BoolFlag{
+			Name:   "verify",
+			Usage:  "verify the chart provenance against the VERIFY_KEYRING secret before deploying",
+			EnvVar: "PLUGIN_VERIFY,VERIFY",
+		},
+		cli.StringFlag{
+			Name:   "chart-digest",
+			Usage:  "expected SHA-256 digest of the chart archive",
+			EnvVar: "PLUGIN_CHART_DIGEST,CHART_DIGEST",
+		},
+		cli.BoolFlag{
+			Name:   "sanitize-names",
+			Usage:  "if set, release and namespace are turned into valid Kubernetes names",
+			EnvVar: "PLUGIN_SANITIZE_NAMES,SANITIZE_NAMES",
+		},
+		cli.BoolFlag{
+			Name:   "preview",
+			Usage:  "if set, pull requests are deployed to their own release and namespace",
+			EnvVar: "PLUGIN_PREVIEW,PREVIEW",
+		},
+		cli.StringFlag{
+			Name:   "preview-ttl",
+			Usage:  "how long a preview environment is kept, recorded in its namespace labels (default 168h)",
+			EnvVar: "PLUGIN_PREVIEW_TTL,PREVIEW_TTL",
+		},
+		cli.StringFlag{
+			Name:   "preview-url-file",
+			Usage:  "file the url of the preview environment is written to",
+			EnvVar: "PLUGIN_PREVIEW_URL_FILE,PREVIEW_URL_FILE",
+		},
+		cli.StringFlag{
+			Name:   "cleanup-ttl",
+			Usage:  "releases matching cleanup_pattern not deployed for this long are deleted by the cleanup command",
+			EnvVar: "PLUGIN_CLEANUP_TTL,CLEANUP_TTL",
+		},
+		cli.StringFlag{
+			Name:   "cleanup-pattern",
+			Usage:  "regular expression of the release names the cleanup command can delete",
+			EnvVar: "PLUGIN_CLEANUP_PATTERN,CLEANUP_PATTERN",
+		},
+		cli.StringFlag{
+			Name:   "cleanup-selector",
+			Usage:  "label selector of the namespaces the cleanup command deletes once expired (default drone-helm/preview=true)",
+			EnvVar: "PLUGIN_CLEANUP_SELECTOR,CLEANUP_SELECTOR",
+		},
+		cli.StringSliceFlag{
+			Name:   "cleanup-protected",
+			Usage:  "release and namespace names, or glob patterns, the cleanup command never deletes",
+			EnvVar: "PLUGIN_CLEANUP_PROTECTED,CLEANUP_PROTECTED",
+		},
+		cli.BoolFlag{
+			Name:   "create-namespace",
+			Usage:  "if set, the namespace is created before the upgrade if it doesn't exist",
+			EnvVar: "PLUGIN_CREATE_NAMESPACE,CREATE_NAMESPACE",
+		},
+		cli.StringFlag{
+			Name:   "namespace-labels",
+			Usage:  "labels set on the created namespace, as key=value pairs",
+			EnvVar: "PLUGIN_NAMESPACE_LABELS,NAMESPACE_LABELS",
+		},
+		cli.StringFlag{
+			Name:   "namespace-annotations",
+			Usage:  "annotations set on the created namespace, as key=value pairs",
+			EnvVar: "PLUGIN_NAMESPACE_ANNOTATIONS,NAMESPACE_ANNOTATIONS",
+		},
+		cli.StringFlag{
+			Name:   "output-file",
+			Usage:  "file the status and history commands write the release details to (default helm-<command>.json)",
+			EnvVar: "PLUGIN_OUTPUT_FILE,OUTPUT_FILE",
+		},
+		cli.BoolFlag{
+			Name:   "verify-rollout",
+			Usage:  "if set, waits for the deployments, statefulsets and daemonsets of the release to be rolled out after the upgrade",
+			EnvVar: "PLUGIN_VERIFY_ROLLOUT,VERIFY_ROLLOUT",
+		},
+		cli.StringFlag{
+			Name:   "rollout-timeout",
+			Usage:  "how long to wait for the rollout to complete (default 5m)",
+			EnvVar: "PLUGIN_ROLLOUT_TIMEOUT,ROLLOUT_TIMEOUT",
+		},
+		cli.BoolFlag{
+			Name:   "diagnostics",
+			Usage:  "if set, events, pods and logs of crashing containers are collected when the upgrade fails",
+			EnvVar: "PLUGIN_DIAGNOSTICS,DIAGNOSTICS",
+		},
+		cli.StringFlag{
+			Name:   "diagnostics-file",
+			Usage:  "file the diagnostics are saved to (default helm-diagnostics.txt)",
+			EnvVar: "PLUGIN_DIAGNOSTICS_FILE,DIAGNOSTICS_FILE",
+		},
+		cli.IntFlag{
+			Name:   "diagnostics-log-lines",
+			Usage:  "number of log lines collected from each crashing container (default 50)",
+			EnvVar: "PLUGIN_DIAGNOSTICS_LOG_LINES,DIAGNOSTICS_LOG_LINES",
+		},
+		cli.StringFlag{
+			Name:   "smoke-tests",
+			Usage:  "JSON list of urls, or of checks, or comma separated urls, requested after the upgrade",
+			EnvVar: "PLUGIN_SMOKE_TESTS,SMOKE_TESTS",
+		},
+		cli.BoolFlag{
+			Name:   "smoke-rollback",
+			Usage:  "if set, the release is rolled back to its previous revision when a smoke test fails",
+			EnvVar: "PLUGIN_SMOKE_ROLLBACK,SMOKE_ROLLBACK",
+		},
+		cli.StringFlag{
+			Name:   "strategy",
+			Usage:  "how the release is upgraded: canary deploys and checks a <release>-canary release first, bluegreen alternates between <release>-blue and <release>-green",
+			EnvVar: "PLUGIN_STRATEGY,STRATEGY",
+		},
+		cli.StringFlag{
+			Name:   "canary-values",
+			Usage:  "values set on the canary release on top of the release values, e.g. replicaCount=1",
+			EnvVar: "PLUGIN_CANARY_VALUES,CANARY_VALUES",
+		},
+		cli.StringFlag{
+			Name:   "canary-bake",
+			Usage:  "how long the canary release has to stay healthy before it is promoted",
+			EnvVar: "PLUGIN_CANARY_BAKE,CANARY_BAKE",
+		},
+		cli.StringFlag{
+			Name:   "bluegreen-key",
+			Usage:  "values key switching traffic between blue and green (default active)",
+			EnvVar: "PLUGIN_BLUEGREEN_KEY,BLUEGREEN_KEY",
+		},
+		cli.StringFlag{
+			Name:   "bluegreen-router",
+			Usage:  "release routing traffic to the live colour, with bluegreen_key set to blue or green",
+			EnvVar: "PLUGIN_BLUEGREEN_ROUTER,BLUEGREEN_ROUTER",
+		},
+		cli.StringFlag{
+			Name:   "bluegreen-router-chart",
+			Usage:  "chart of the router release",
+			EnvVar: "PLUGIN_BLUEGREEN_ROUTER_CHART,BLUEGREEN_ROUTER_CHART",
+		},
+		cli.BoolFlag{
+			Name:   "bluegreen-remove-old",
+			Usage:  "if set, the previous colour release is removed once traffic has been switched",
+			EnvVar: "PLUGIN_BLUEGREEN_REMOVE_OLD,BLUEGREEN_REMOVE_OLD",
+		},
+		cli.BoolFlag{
+			Name:   "lock",
+			Usage:  "if set, a lock is held on the release while it is upgraded or deleted",
+			EnvVar: "PLUGIN_LOCK,LOCK",
+		},
+		cli.StringFlag{
+			Name:   "lock-timeout",
+			Usage:  "how long to wait for the lock held by another build (default 10m)",
+			EnvVar: "PLUGIN_LOCK_TIMEOUT,LOCK_TIMEOUT",
+		},
+		cli.StringFlag{
+			Name:   "lock-ttl",
+			Usage:  "how long a lock that isn't renewed is kept before other builds take it over (default 30m)",
+			EnvVar: "PLUGIN_LOCK_TTL,LOCK_TTL",
+		},
+		cli.StringFlag{
+			Name:   "pending-recovery",
+			Usage:  "what to do with a release stuck in a pending state before upgrading it: rollback or fail",
+			EnvVar: "PLUGIN_PENDING_RECOVERY,PENDING_RECOVERY",
+		},
+		cli.StringFlag{
+			Name:   "policy",
+			Usage:  "rules the deploy has to follow, as YAML or the path of a YAML file",
+			EnvVar: "PLUGIN_POLICY,POLICY",
+		},
+		cli.BoolFlag{
+			Name:   "validate-values",
+			Usage:  "if set, the values are validated against the chart values.schema.json before upgrade and lint",
+			EnvVar: "PLUGIN_VALIDATE_VALUES,VALIDATE_VALUES",
+		},
+		cli.StringFlag{
+			Name:   "values-schema",
+			Usage:  "JSON schema the values are validated against instead of the chart one",
+			EnvVar: "PLUGIN_VALUES_SCHEMA,VALUES_SCHEMA",
+		},
+		cli.StringFlag{
+			Name:   "values-file",
+			Usage:  "file the values command writes the unmasked values to, readable by its owner only",
+			EnvVar: "PLUGIN_VALUES_FILE,VALUES_FILE",
+		},
+		cli.StringFlag{
+			Name:   "vault-addr",
+			Usage:  "address of the Vault server the vault: references of values are read from",
+			EnvVar: "PLUGIN_VAULT_ADDR,VAULT_ADDR",
+		},
 	}
 	if err := app.Run(os.Args); err != nil {
 		logrus.Fatal(err)
@@ -175,38 +455,94 @@ func run(c *cli.Context) error {
 	}
 	p := plugin.Plugin{
 		Config: plugin.Config{
-			APIServer:          c.String("api_server"),
-			Token:              c.String("token"),
-			Certificate:        c.String("certificate"),
-			ServiceAccount:     c.String("service-account"),
-			KubeConfig:         c.String("kube-config"),
-			HelmCommand:        c.String("helm_command"),
-			Namespace:          c.String("namespace"),
-			SkipTLSVerify:      c.Bool("skip_tls_verify"),
-			Values:             c.String("values"),
-			StringValues:       c.String("string_values"),
-			ValuesFiles:        c.String("values_files"),
-			Release:            c.String("release"),
-			HelmRepos:          c.StringSlice("helm_repos"),
-			Chart:              c.String("chart"),
-			Version:            c.String("chart-version"),
-			EKSCluster:         c.String("eks_cluster"),
-			EKSRoleARN:         c.String("eks_role_arn"),
-			Debug:              c.Bool("debug"),
-			DryRun:             c.Bool("dry-run"),
-			Secrets:            c.StringSlice("secrets"),
-			Prefix:             c.String("prefix"),
-			TillerNs:           c.String("tiller-ns"),
-			Wait:               c.Bool("wait"),
-			RecreatePods:       c.Bool("recreate-pods"),
-			ClientOnly:         c.Bool("client-only"),
-			CanaryImage:        c.Bool("canary-image"),
-			Upgrade:            c.Bool("upgrade"),
-			ReuseValues:        c.Bool("reuse-values"),
-			Timeout:            c.String("timeout"),
-			Force:              c.Bool("force"),
-			UpdateDependencies: c.Bool("update-dependencies"),
-			StableRepoURL:      c.String("stable_repo_url"),
+			APIServer:                 c.String("api_server"),
+			Token:                     c.String("token"),
+			Certificate:               c.String("certificate"),
+			ServiceAccount:            c.String("service-account"),
+			KubeConfig:                c.String("kube-config"),
+			HelmCommand:               c.String("helm_command"),
+			Namespace:                 c.String("namespace"),
+			SkipTLSVerify:             c.Bool("skip_tls_verify"),
+			Values:                    c.String("values"),
+			StringValues:              c.String("string_values"),
+			ValuesFiles:               c.String("values_files"),
+			Release:                   c.String("release"),
+			HelmRepos:                 c.StringSlice("helm_repos"),
+			Chart:                     c.String("chart"),
+			Version:                   c.String("chart-version"),
+			EKSCluster:                c.String("eks_cluster"),
+			EKSRoleARN:                c.String("eks_role_arn"),
+			Debug:                     c.Bool("debug"),
+			DryRun:                    c.Bool("dry-run"),
+			Secrets:                   c.StringSlice("secrets"),
+			Prefix:                    c.String("prefix"),
+			TillerNs:                  c.String("tiller-ns"),
+			Wait:                      c.Bool("wait"),
+			RecreatePods:              c.Bool("recreate-pods"),
+			ClientOnly:                c.Bool("client-only"),
+			CanaryImage:               c.Bool("canary-image"),
+			Upgrade:                   c.Bool("upgrade"),
+			ReuseValues:               c.Bool("reuse-values"),
+			Timeout:                   c.String("timeout"),
+			Force:                     c.Bool("force"),
+			UpdateDependencies:        c.Bool("update-dependencies"),
+			StableRepoURL:             c.String("stable_repo_url"),
+			TLS:                       c.Bool("tls"),
+			TLSVerify:                 c.Bool("tls-verify"),
+			TLSCACert:                 c.String("tls-ca-cert"),
+			TLSCert:                   c.String("tls-cert"),
+			TLSKey:                    c.String("tls-key"),
+			TillerTLSCert:             c.String("tiller-tls-cert"),
+			TillerTLSKey:              c.String("tiller-tls-key"),
+			TillerServiceAccount:      c.String("tiller-service-account"),
+			TillerNamespaces:          c.StringSlice("tiller-namespaces"),
+			TillerClusterAdmin:        c.Bool("tiller-cluster-admin"),
+			HistoryMax:                c.String("history-max"),
+			RepoInsecureSkipTLSVerify: c.StringSlice("repo-insecure-skip-tls-verify"),
+			ChartCache:                c.String("chart-cache"),
+			RegistryPlainHTTP:         c.Bool("registry-plain-http"),
+			PackageDir:                c.String("package-dir"),
+			AppVersion:                c.String("app-version"),
+			SignKey:                   c.String("sign-key"),
+			PushRepo:                  c.String("push-repo"),
+			AutoVersion:               c.Bool("auto-version"),
+			Verify:                    c.Bool("verify"),
+			ChartDigest:               c.String("chart-digest"),
+			SanitizeNames:             c.Bool("sanitize-names"),
+			Preview:                   c.Bool("preview"),
+			PreviewTTL:                c.String("preview-ttl"),
+			PreviewURLFile:            c.String("preview-url-file"),
+			CleanupTTL:                c.String("cleanup-ttl"),
+			CleanupPattern:            c.String("cleanup-pattern"),
+			CleanupSelector:           c.String("cleanup-selector"),
+			CleanupProtected:          c.StringSlice("cleanup-protected"),
+			CreateNamespace:           c.Bool("create-namespace"),
+			NamespaceLabels:           c.String("namespace-labels"),
+			NamespaceAnnotations:      c.String("namespace-annotations"),
+			OutputFile:                c.String("output-file"),
+			VerifyRollout:             c.Bool("verify-rollout"),
+			RolloutTimeout:            c.String("rollout-timeout"),
+			Diagnostics:               c.Bool("diagnostics"),
+			DiagnosticsFile:           c.String("diagnostics-file"),
+			DiagnosticsLogLines:       c.Int("diagnostics-log-lines"),
+			SmokeTests:                c.String("smoke-tests"),
+			SmokeRollback:             c.Bool("smoke-rollback"),
+			Strategy:                  c.String("strategy"),
+			CanaryValues:              c.String("canary-values"),
+			CanaryBake:                c.String("canary-bake"),
+			BlueGreenKey:              c.String("bluegreen-key"),
+			BlueGreenRouter:           c.String("bluegreen-router"),
+			BlueGreenRouterChart:      c.String("bluegreen-router-chart"),
+			BlueGreenRemoveOld:        c.Bool("bluegreen-remove-old"),
+			Lock:                      c.Bool("lock"),
+			LockTimeout:               c.String("lock-timeout"),
+			LockTTL:                   c.String("lock-ttl"),
+			PendingRecovery:           c.String("pending-recovery"),
+			Policy:                    c.String("policy"),
+			ValidateValues:            c.Bool("validate-values"),
+			ValuesSchema:              c.String("values-schema"),
+			ValuesFile:                c.String("values-file"),
+			VaultAddr:                 c.String("vault-addr"),
 		},
 	}
 	return p.Exec()
@@ -0,0 +1,265 @@
+package plugin
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+const defaultBlueGreenKey = "active"
+
+var colours = []string{"blue", "green"}
+
+// the chart name and version of a release, as helm prints them, e.g.
+// my-chart-1.4.0
+var releaseChartExp = regexp.MustCompile(`^(.+?)-(v?\d+\.\d+\.\d+\S*)$`)
+
+// blueGreen tracks a blue/green upgrade: the colour serving traffic, if
+// any, with the chart and version it runs, and the idle one being deployed
+type blueGreen struct {
+	release     string
+	live        string
+	liveChart   string
+	liveVersion string
+	idle        string
+}
+
+// isBlueGreen tells if the upgrade deploys the idle colour of the release
+func isBlueGreen(p *Plugin) bool {
+	return p.Config.Strategy == "bluegreen" && len(p.command) > 0 && p.command[0] == "upgrade"
+}
+
+func (b *blueGreen) colourRelease(colour string) string {
+	name, _ := sanitizeName(b.release+"-"+colour, maxReleaseLength)
+	return name
+}
+
+func blueGreenKey(p *Plugin) string {
+	if p.Config.BlueGreenKey != "" {
+		return p.Config.BlueGreenKey
+	}
+	return defaultBlueGreenKey
+}
+
+func doHelmGetValues(p *Plugin, release string) []string {
+	get := []string{
+		"get",
+		"values",
+		release,
+		"--all",
+	}
+	if p.Config.TillerNs != "" {
+		get = append(get, "--tiller-namespace")
+		get = append(get, p.Config.TillerNs)
+	}
+	return append(get, tlsFlags(p)...)
+}
+
+// releaseValue reads a dotted key, e.g. service.active, from the values
+// the release was deployed with
+func releaseValue(p *Plugin, release string, key string) (string, error) {
+	out, err := runCommandOutput(doHelmGetValues(p, release))
+	if err != nil {
+		return "", fmt.Errorf("Error reading values of %s: %v", release, err)
+	}
+	var values interface{}
+	if err := yaml.Unmarshal(out, &values); err != nil {
+		return "", fmt.Errorf("Error parsing values of %s: %v", release, err)
+	}
+	for _, k := range strings.Split(key, ".") {
+		node, ok := values.(map[interface{}]interface{})
+		if !ok {
+			return "", nil
+		}
+		values = node[k]
+	}
+	if values == nil {
+		return "", nil
+	}
+	return fmt.Sprint(values), nil
+}
+
+// liveColour finds out which colour serves traffic from the deployed
+// releases: the value of bluegreen_key in the router release, or the
+// colour release where it is true
+func liveColour(p *Plugin, b *blueGreen) (string, error) {
+	releases, err := listReleases(p)
+	if err != nil {
+		return "", err
+	}
+	deployed := map[string]bool{}
+	for _, release := range releases {
+		deployed[release.Name] = true
+	}
+
+	key := blueGreenKey(p)
+	if p.Config.BlueGreenRouter != "" {
+		if !deployed[p.Config.BlueGreenRouter] {
+			return "", nil
+		}
+		colour, err := releaseValue(p, p.Config.BlueGreenRouter, key)
+		if err != nil || colour == "" || containsString(colours, colour) {
+			return colour, err
+		}
+		return "", fmt.Errorf("Error: %s of router release %s is %s, expected blue or green", key, p.Config.BlueGreenRouter, colour)
+	}
+	for _, colour := range colours {
+		if !deployed[b.colourRelease(colour)] {
+			continue
+		}
+		active, err := releaseValue(p, b.colourRelease(colour), key)
+		if err != nil {
+			return "", err
+		}
+		if active == "true" {
+			return colour, nil
+		}
+	}
+	return "", nil
+}
+
+// prepareBlueGreen points the upgrade at the idle colour release. Without
+// a router release, it is deployed with bluegreen_key set to false until
+// it is promoted.
+func prepareBlueGreen(p *Plugin) (*blueGreen, error) {
+	if p.Config.Release == "" {
+		return nil, fmt.Errorf("Error: release is needed to deploy blue/green.")
+	}
+	if p.Config.BlueGreenRouter != "" && p.Config.BlueGreenRouterChart == "" {
+		return nil, fmt.Errorf("Error: bluegreen_router_chart is needed to switch the router release.")
+	}
+	b := &blueGreen{release: p.Config.Release}
+	live, err := liveColour(p, b)
+	if err != nil {
+		return nil, err
+	}
+	b.live = live
+	b.idle = colours[0]
+	if live == colours[0] {
+		b.idle = colours[1]
+	}
+	if live == "" {
+		fmt.Printf("no live colour for %s, deploying %s\n", b.release, b.idle)
+	} else {
+		fmt.Printf("%s is live for %s, deploying %s\n", live, b.release, b.idle)
+	}
+	if live != "" && p.Config.BlueGreenRouter == "" {
+		if b.liveChart, b.liveVersion, err = deployedChart(p, b.colourRelease(live)); err != nil {
+			return nil, err
+		}
+	}
+
+	p.Config.Release = b.colourRelease(b.idle)
+	if p.Config.BlueGreenRouter == "" {
+		p.Config.Values = joinValues(p.Config.Values, blueGreenKey(p)+"=false")
+	}
+	setUpgradeCommand(p)
+	return b, nil
+}
+
+// deployedChart returns the chart and version to switch the traffic of a
+// release without upgrading it: the configured chart at the version the
+// release runs. A local chart can only be used at its own version.
+func deployedChart(p *Plugin, release string) (string, string, error) {
+	status, err := releaseStatus(releaseCopy(p, release))
+	if err != nil {
+		return "", "", err
+	}
+	match := releaseChartExp.FindStringSubmatch(status.Chart)
+	if match == nil {
+		return "", "", fmt.Errorf("Error: can't tell the chart version of %s from %s", release, status.Chart)
+	}
+	version := match[2]
+	if _, err := os.Stat(p.Config.Chart); err != nil {
+		return p.Config.Chart, version, nil
+	}
+
+	data, err := readChartFile(p.Config.Chart, "Chart.yaml")
+	if err != nil {
+		return "", "", fmt.Errorf("Error reading %s: %v", p.Config.Chart, err)
+	}
+	metadata := chartMetadata{}
+	if err := yaml.Unmarshal(data, &metadata); err != nil {
+		return "", "", fmt.Errorf("Invalid Chart.yaml in %s: %v", p.Config.Chart, err)
+	}
+	if metadata.Version != version {
+		return "", "", fmt.Errorf("Error: %s runs chart version %s, and switching its traffic with %s would upgrade it to %s. "+
+			"Use a chart from a repository or a bluegreen_router release.", release, version, p.Config.Chart, metadata.Version)
+	}
+	return p.Config.Chart, "", nil
+}
+
+// setValue upgrades a release keeping its values but the one given
+func setValue(p *Plugin, release string, chart string, version string, key string, value string) error {
+	c := releaseCopy(p, release)
+	c.Config.Chart = chart
+	c.Config.Version = version
+	c.Config.Values = key + "=" + value
+	c.Config.StringValues = ""
+	c.Config.ValuesFiles = ""
+	c.Config.ReuseValues = true
+	setUpgradeCommand(c)
+	if err := runCommand(c.command); err != nil {
+		return fmt.Errorf("Error setting %s=%s on %s: %v", key, value, release, err)
+	}
+	return nil
+}
+
+// chart returns the chart and version a colour release is switched with,
+// so the live colour stays on the ones it was deployed with
+func (b *blueGreen) chart(p *Plugin, colour string) (string, string) {
+	if colour == b.live {
+		return b.liveChart, b.liveVersion
+	}
+	return p.Config.Chart, p.Config.Version
+}
+
+// route sends traffic to the given colour
+func (b *blueGreen) route(p *Plugin, colour string, old string) error {
+	key := blueGreenKey(p)
+	fmt.Printf("switching traffic of %s to %s\n", b.release, colour)
+	if p.Config.BlueGreenRouter != "" {
+		// chart_version pins the application chart, not the router one
+		return setValue(p, p.Config.BlueGreenRouter, p.Config.BlueGreenRouterChart, "", key, colour)
+	}
+	chart, version := b.chart(p, colour)
+	if err := setValue(p, b.colourRelease(colour), chart, version, key, "true"); err != nil {
+		return err
+	}
+	if old == "" {
+		return nil
+	}
+	chart, version = b.chart(p, old)
+	return setValue(p, b.colourRelease(old), chart, version, key, "false")
+}
+
+// promote switches traffic to the freshly deployed colour and runs the
+// smoke tests, switching back when they fail and smoke_rollback is set.
+// The old colour is removed afterwards if bluegreen_remove_old is set.
+func (b *blueGreen) promote(p *Plugin) error {
+	if err := b.route(p, b.idle, b.live); err != nil {
+		return err
+	}
+	if p.Config.SmokeTests != "" {
+		c := releaseCopy(p, p.Config.Release)
+		if err := runSmokeTests(c); err != nil {
+			if p.Config.SmokeRollback && b.live != "" {
+				if routeErr := b.route(p, b.live, b.idle); routeErr != nil {
+					return fmt.Errorf("%v, and switching back to %s failed: %v", err, b.live, routeErr)
+				}
+			}
+			return err
+		}
+	}
+	if p.Config.BlueGreenRemoveOld && b.live != "" {
+		old := b.colourRelease(b.live)
+		fmt.Println("removing old colour release " + old)
+		if err := runCommand(doHelmPurge(p, old)); err != nil {
+			return fmt.Errorf("Error removing %s: %v", old, err)
+		}
+	}
+	return nil
+}
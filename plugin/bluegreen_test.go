@@ -0,0 +1,141 @@
+package plugin
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBlueGreenWithValuesKey(t *testing.T) {
+	calls, restore := fakeHelm(t, `case "$1 $2 $3" in
+"list --all --output"*) echo '[{"Name":"app-blue"},{"Name":"app-green"}]' ;;
+"get values app-blue") echo 'active: true' ;;
+"get values app-green") echo 'active: false' ;;
+"history app-blue --output") echo '[{"revision":3,"status":"DEPLOYED","chart":"app-1.3.0"}]' ;;
+esac
+exit 0`)
+	defer restore()
+
+	plugin := &Plugin{
+		Config: Config{
+			HelmCommand:        "upgrade",
+			Release:            "app",
+			Chart:              "my-charts/app",
+			Version:            "1.4.0",
+			Values:             "image.tag=2",
+			Strategy:           "bluegreen",
+			BlueGreenRemoveOld: true,
+		},
+	}
+	setHelmCommand(plugin)
+	if !isBlueGreen(plugin) {
+		t.Fatal("the upgrade should be blue/green")
+	}
+	switchover, err := prepareBlueGreen(plugin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if switchover.live != "blue" || switchover.idle != "green" {
+		t.Errorf("unexpected colours %+v", switchover)
+	}
+	if strings.Join(plugin.command, " ") != "upgrade --install app-green my-charts/app --version 1.4.0 --set image.tag=2,active=false" {
+		t.Errorf("unexpected upgrade command %v", plugin.command)
+	}
+	if err := switchover.promote(plugin); err != nil {
+		t.Fatal(err)
+	}
+
+	data, _ := ioutil.ReadFile(calls)
+	expected := "list --all --output json\n" +
+		"get values app-blue --all\n" +
+		"history app-blue --output json --max 1\n" +
+		"upgrade --install app-green my-charts/app --version 1.4.0 --set active=true --reuse-values\n" +
+		"upgrade --install app-blue my-charts/app --version 1.3.0 --set active=false --reuse-values\n" +
+		"delete app-blue --purge\n"
+	if string(data) != expected {
+		t.Errorf("unexpected helm calls:\n%s", data)
+	}
+}
+
+func TestBlueGreenWithRouter(t *testing.T) {
+	calls, restore := fakeHelm(t, `case "$1 $2 $3" in
+"list --all --output"*) echo '[{"Name":"app-green"},{"Name":"app-router"}]' ;;
+"get values app-router") printf 'traffic:\n  colour: green\n' ;;
+esac
+exit 0`)
+	defer restore()
+
+	plugin := &Plugin{
+		Config: Config{
+			HelmCommand:          "upgrade",
+			Release:              "app",
+			Chart:                "my-charts/app",
+			Version:              "1.4.0",
+			Strategy:             "bluegreen",
+			BlueGreenKey:         "traffic.colour",
+			BlueGreenRouter:      "app-router",
+			BlueGreenRouterChart: "./router",
+		},
+	}
+	setHelmCommand(plugin)
+	switchover, err := prepareBlueGreen(plugin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if switchover.live != "green" || plugin.Config.Release != "app-blue" {
+		t.Errorf("unexpected colours %+v deploying %s", switchover, plugin.Config.Release)
+	}
+	if err := switchover.promote(plugin); err != nil {
+		t.Fatal(err)
+	}
+
+	data, _ := ioutil.ReadFile(calls)
+	if !strings.HasSuffix(string(data), "upgrade --install app-router ./router --set traffic.colour=blue --reuse-values\n") {
+		t.Errorf("the router should have been switched:\n%s", data)
+	}
+}
+
+func TestBlueGreenFirstDeploy(t *testing.T) {
+	_, restore := fakeHelm(t, "exit 0")
+	defer restore()
+
+	plugin := &Plugin{Config: Config{HelmCommand: "upgrade", Release: "app", Chart: "./chart", Strategy: "bluegreen"}}
+	setHelmCommand(plugin)
+	switchover, err := prepareBlueGreen(plugin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if switchover.live != "" || plugin.Config.Release != "app-blue" {
+		t.Errorf("the first deploy should be blue, got %+v", switchover)
+	}
+}
+
+func TestBlueGreenLocalChartVersion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bluegreen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "Chart.yaml"), []byte("name: app\nversion: 1.3.0\n"), 0644)
+
+	for deployed, ok := range map[string]bool{"app-1.3.0": true, "app-1.2.0": false} {
+		_, restore := fakeHelm(t, `case "$1 $2 $3" in
+"list --all --output"*) echo '[{"Name":"app-blue"}]' ;;
+"get values app-blue") echo 'active: true' ;;
+"history app-blue --output") echo '[{"revision":3,"status":"DEPLOYED","chart":"`+deployed+`"}]' ;;
+esac
+exit 0`)
+		plugin := &Plugin{Config: Config{HelmCommand: "upgrade", Release: "app", Chart: dir, Strategy: "bluegreen"}}
+		setHelmCommand(plugin)
+		switchover, err := prepareBlueGreen(plugin)
+		if ok && (err != nil || switchover.liveChart != dir || switchover.liveVersion != "") {
+			t.Errorf("the live colour running %s should be switched with the local chart, got %+v %v", deployed, switchover, err)
+		}
+		if !ok && (err == nil || !strings.Contains(err.Error(), "runs chart version 1.2.0")) {
+			t.Errorf("the live colour running %s can't be switched with the local chart, got %v", deployed, err)
+		}
+		restore()
+	}
+}
@@ -0,0 +1,120 @@
+package plugin
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const canarySuffix = "-canary"
+
+// isCanary tells if the upgrade goes through a canary release first
+func isCanary(p *Plugin) bool {
+	return p.Config.Strategy == "canary" && len(p.command) > 0 && p.command[0] == "upgrade"
+}
+
+// releaseCopy returns a plugin deploying the same chart as another release
+func releaseCopy(p *Plugin, release string) *Plugin {
+	c := &Plugin{Config: p.Config, secrets: p.secrets}
+	c.Config.Release = release
+	c.Config.SmokeRollback = false
+	return c
+}
+
+// joinValues appends --set values to the configured ones
+func joinValues(values string, extra string) string {
+	values, extra = unQuote(values), unQuote(extra)
+	if values == "" {
+		return extra
+	}
+	if extra == "" {
+		return values
+	}
+	return values + "," + extra
+}
+
+// deployCanary deploys the chart as <release>-canary, with canary_values
+// on top of the release values, and checks it before the release itself
+// is upgraded: its rollout is verified if verify_rollout is set, the smoke
+// tests are run, and it is left to bake for canary_bake. The canary is
+// torn down when it fails; otherwise the returned func removes it once
+// the release has been promoted.
+func deployCanary(p *Plugin) (func(), error) {
+	noop := func() {}
+	if p.Config.Release == "" {
+		return noop, fmt.Errorf("Error: release is needed to deploy a canary.")
+	}
+	var bake time.Duration
+	if p.Config.CanaryBake != "" {
+		var err error
+		if bake, err = time.ParseDuration(p.Config.CanaryBake); err != nil {
+			return noop, fmt.Errorf("Error: invalid canary_bake %s: %v", p.Config.CanaryBake, err)
+		}
+	}
+	name, err := sanitizeName(p.Config.Release+canarySuffix, maxReleaseLength)
+	if err != nil {
+		return noop, err
+	}
+
+	canary := releaseCopy(p, name)
+	canary.Config.Values = joinValues(p.Config.Values, p.Config.CanaryValues)
+	setUpgradeCommand(canary)
+	if p.Config.PendingRecovery != "" {
+		if err := recoverPendingRelease(canary); err != nil {
+			return noop, err
+		}
+	}
+	fmt.Println("deploying canary release " + name)
+	if err := runCommand(canary.command); err != nil {
+		return noop, tearDownCanary(canary, fmt.Errorf("Error running helm command: %s", redact(p, strings.Join(canary.command, " "))))
+	}
+	if p.Config.DryRun {
+		return noop, nil
+	}
+
+	if err := checkCanary(canary, bake); err != nil {
+		return noop, tearDownCanary(canary, err)
+	}
+	fmt.Printf("canary release %s is healthy, promoting %s\n", name, p.Config.Release)
+	return func() {
+		if err := runCommand(doHelmPurge(canary, name)); err != nil {
+			fmt.Printf("Error removing canary release %s: %v\n", name, err)
+		}
+	}, nil
+}
+
+// checkCanary verifies the canary, then again after it baked
+func checkCanary(canary *Plugin, bake time.Duration) error {
+	check := func() error {
+		if canary.Config.VerifyRollout {
+			if err := verifyRollout(canary); err != nil {
+				return err
+			}
+		}
+		if canary.Config.SmokeTests != "" {
+			return runSmokeTests(canary)
+		}
+		return nil
+	}
+	if err := check(); err != nil {
+		return err
+	}
+	if bake == 0 {
+		return nil
+	}
+	fmt.Printf("baking canary release %s for %s\n", canary.Config.Release, bake)
+	time.Sleep(bake)
+	return check()
+}
+
+// tearDownCanary removes the failed canary, returning why it failed
+func tearDownCanary(canary *Plugin, err error) error {
+	if canary.Config.Diagnostics {
+		collectDiagnostics(canary)
+	}
+	fmt.Println("removing failed canary release " + canary.Config.Release)
+	if purgeErr := runCommand(doHelmPurge(canary, canary.Config.Release)); purgeErr != nil {
+		return fmt.Errorf("%v, and the canary couldn't be removed: %v", err, purgeErr)
+	}
+	return err
+}
@@ -0,0 +1,75 @@
+package plugin
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDeployCanary(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	calls, restore := fakeHelm(t, "exit 0")
+	defer restore()
+
+	plugin := &Plugin{
+		Config: Config{
+			HelmCommand:  "upgrade",
+			Release:      "app",
+			Chart:        "./chart",
+			Values:       `"image.tag=1.2"`,
+			Strategy:     "canary",
+			CanaryValues: "replicaCount=1",
+			SmokeTests:   `["` + server.URL + `"]`,
+		},
+	}
+	setHelmCommand(plugin)
+	if !isCanary(plugin) {
+		t.Fatal("the upgrade should go through a canary")
+	}
+	removeCanary, err := deployCanary(plugin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadFile(calls)
+	if string(data) != "upgrade --install app-canary ./chart --set image.tag=1.2,replicaCount=1\n" {
+		t.Errorf("unexpected helm calls:\n%s", data)
+	}
+
+	removeCanary()
+	data, _ = ioutil.ReadFile(calls)
+	if string(data) != "upgrade --install app-canary ./chart --set image.tag=1.2,replicaCount=1\ndelete app-canary --purge\n" {
+		t.Errorf("the canary should have been removed:\n%s", data)
+	}
+}
+
+func TestDeployCanaryFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	calls, restore := fakeHelm(t, "exit 0")
+	defer restore()
+
+	plugin := &Plugin{
+		Config: Config{
+			HelmCommand:   "upgrade",
+			Release:       "app",
+			Chart:         "./chart",
+			Strategy:      "canary",
+			SmokeTests:    `[{"url": "` + server.URL + `", "retries": 1, "interval": "1ms"}]`,
+			SmokeRollback: true,
+		},
+	}
+	setHelmCommand(plugin)
+	if _, err := deployCanary(plugin); err == nil {
+		t.Fatal("a failing canary should not be promoted")
+	}
+	data, _ := ioutil.ReadFile(calls)
+	if string(data) != "upgrade --install app-canary ./chart\ndelete app-canary --purge\n" {
+		t.Errorf("the canary should have been torn down without rollback:\n%s", data)
+	}
+}
@@ -0,0 +1,225 @@
+package plugin
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// chartMetadata holds the fields of Chart.yaml the plugin needs
+type chartMetadata struct {
+	Name       string `yaml:"name"`
+	Version    string `yaml:"version"`
+	AppVersion string `yaml:"appVersion"`
+}
+
+// loadChartMetadata reads Chart.yaml from a chart folder
+func loadChartMetadata(chart string) (*chartMetadata, error) {
+	data, err := ioutil.ReadFile(filepath.Join(chart, "Chart.yaml"))
+	if err != nil {
+		return nil, err
+	}
+	metadata := &chartMetadata{}
+	if err := yaml.Unmarshal(data, metadata); err != nil {
+		return nil, fmt.Errorf("Invalid Chart.yaml in %s: %v", chart, err)
+	}
+	if metadata.Name == "" {
+		return nil, fmt.Errorf("Invalid Chart.yaml in %s: name is missing", chart)
+	}
+	return metadata, nil
+}
+
+var semverExp = regexp.MustCompile(`^v?(\d+\.\d+\.\d+)(-[0-9A-Za-z.-]+)?(\+[0-9A-Za-z.-]+)?$`)
+
+// deriveChartVersion computes the chart version and appVersion of a build
+// from the drone environment. Tag builds use the tag, other builds the
+// chart version with the build number and commit, e.g.
+// 1.4.0-build.123+abc1234.
+func deriveChartVersion(base string) (string, string, error) {
+	if tag := os.Getenv("DRONE_TAG"); tag != "" && os.Getenv("DRONE_BUILD_EVENT") == "tag" {
+		if !semverExp.MatchString(tag) {
+			return "", "", fmt.Errorf("Error: tag %s is not a SemVer version", tag)
+		}
+		return strings.TrimPrefix(tag, "v"), tag, nil
+	}
+
+	matches := semverExp.FindStringSubmatch(base)
+	if matches == nil {
+		return "", "", fmt.Errorf("Error: chart version %s is not a SemVer version", base)
+	}
+	version := matches[1]
+	prerelease := strings.TrimPrefix(matches[2], "-")
+	if build := os.Getenv("DRONE_BUILD_NUMBER"); build != "" {
+		if prerelease != "" {
+			prerelease += "."
+		}
+		prerelease += "build." + build
+	}
+	if prerelease != "" {
+		version += "-" + prerelease
+	}
+
+	appVersion := ""
+	if sha := os.Getenv("DRONE_COMMIT_SHA"); sha != "" {
+		if len(sha) > 7 {
+			sha = sha[:7]
+		}
+		version += "+" + sha
+		appVersion = sha
+	}
+	return version, appVersion, nil
+}
+
+// versionChart sets the derived version and appVersion on a copy of the
+// local chart, which the plugin then uses instead of the original. The
+// returned function removes the copy.
+func versionChart(p *Plugin) (func(), error) {
+	noop := func() {}
+	if info, err := os.Stat(p.Config.Chart); err != nil || !info.IsDir() {
+		// not a local chart folder, there is nothing to rewrite
+		return noop, nil
+	}
+	metadata, err := loadChartMetadata(p.Config.Chart)
+	if err != nil {
+		return noop, err
+	}
+
+	version, appVersion, err := deriveChartVersion(metadata.Version)
+	if err != nil {
+		return noop, err
+	}
+	if p.Config.Version != "" {
+		version = p.Config.Version
+	}
+	if p.Config.AppVersion != "" {
+		appVersion = p.Config.AppVersion
+	}
+
+	dir, err := ioutil.TempDir("", "chart")
+	if err != nil {
+		return noop, err
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+	// helm wants the chart folder to be named after the chart
+	chart := filepath.Join(dir, filepath.Base(filepath.Clean(p.Config.Chart)))
+	if err := copyDir(p.Config.Chart, chart); err != nil {
+		cleanup()
+		return noop, err
+	}
+	if err := setChartVersion(chart, version, appVersion); err != nil {
+		cleanup()
+		return noop, err
+	}
+
+	if p.Config.Debug {
+		log.Printf("using chart version %s and appVersion %s\n", version, appVersion)
+	}
+	p.Config.Chart = chart
+	p.Config.Version = version
+	p.Config.AppVersion = appVersion
+	return cleanup, nil
+}
+
+// setChartVersion rewrites version and appVersion in Chart.yaml, keeping
+// the order of the other fields
+func setChartVersion(chart string, version string, appVersion string) error {
+	path := filepath.Join(chart, "Chart.yaml")
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	fields := yaml.MapSlice{}
+	if err := yaml.Unmarshal(data, &fields); err != nil {
+		return fmt.Errorf("Invalid Chart.yaml in %s: %v", chart, err)
+	}
+	fields = setMapSliceKey(fields, "version", version)
+	if appVersion != "" {
+		fields = setMapSliceKey(fields, "appVersion", appVersion)
+	}
+	if data, err = yaml.Marshal(fields); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+func setMapSliceKey(fields yaml.MapSlice, key string, value interface{}) yaml.MapSlice {
+	for i := range fields {
+		if fields[i].Key == key {
+			fields[i].Value = value
+			return fields
+		}
+	}
+	return append(fields, yaml.MapItem{Key: key, Value: value})
+}
+
+// copyDir copies the src folder to dst
+func copyDir(src string, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if info.IsDir() {
+			return os.MkdirAll(target, info.Mode().Perm()|0700)
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(target, data, info.Mode().Perm())
+	})
+}
+
+// readChartFile reads a file of a chart folder or archive, e.g. values.yaml,
+// returning nil if the chart has no such file
+func readChartFile(chart string, name string) ([]byte, error) {
+	info, err := os.Stat(chart)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		data, err := ioutil.ReadFile(filepath.Join(chart, name))
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return data, err
+	}
+
+	f, err := os.Open(chart)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid chart archive %s: %v", chart, err)
+	}
+	archive := tar.NewReader(gz)
+	for {
+		hdr, err := archive.Next()
+		if err == io.EOF {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Invalid chart archive %s: %v", chart, err)
+		}
+		// archives hold the chart in a folder named after it
+		parts := strings.SplitN(hdr.Name, "/", 2)
+		if len(parts) == 2 && parts[1] == name {
+			return ioutil.ReadAll(archive)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package plugin
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func setDroneEnv(envs map[string]string) func() {
+	for _, key := range []string{"DRONE_BUILD_EVENT", "DRONE_TAG", "DRONE_BUILD_NUMBER", "DRONE_COMMIT_SHA"} {
+		os.Unsetenv(key)
+	}
+	for key, value := range envs {
+		os.Setenv(key, value)
+	}
+	return func() {
+		for key := range envs {
+			os.Unsetenv(key)
+		}
+	}
+}
+
+func TestDeriveChartVersion(t *testing.T) {
+	tests := []struct {
+		base       string
+		envs       map[string]string
+		version    string
+		appVersion string
+	}{
+		{
+			base:       "1.4.0",
+			envs:       map[string]string{"DRONE_BUILD_EVENT": "push", "DRONE_BUILD_NUMBER": "123", "DRONE_COMMIT_SHA": "abc1234def5678"},
+			version:    "1.4.0-build.123+abc1234",
+			appVersion: "abc1234",
+		},
+		{
+			base:       "2.0.0-rc.1+old",
+			envs:       map[string]string{"DRONE_BUILD_EVENT": "pull_request", "DRONE_BUILD_NUMBER": "7"},
+			version:    "2.0.0-rc.1.build.7",
+			appVersion: "",
+		},
+		{
+			base:       "1.4.0",
+			envs:       map[string]string{"DRONE_BUILD_EVENT": "tag", "DRONE_TAG": "v1.5.0", "DRONE_BUILD_NUMBER": "124"},
+			version:    "1.5.0",
+			appVersion: "v1.5.0",
+		},
+	}
+	for _, test := range tests {
+		restore := setDroneEnv(test.envs)
+		version, appVersion, err := deriveChartVersion(test.base)
+		restore()
+		if err != nil {
+			t.Errorf("unexpected error for %s: %v", test.base, err)
+			continue
+		}
+		if version != test.version || appVersion != test.appVersion {
+			t.Errorf("got %s/%s and we expected %s/%s", version, appVersion, test.version, test.appVersion)
+		}
+	}
+
+	restore := setDroneEnv(map[string]string{"DRONE_BUILD_EVENT": "tag", "DRONE_TAG": "release-1"})
+	defer restore()
+	if _, _, err := deriveChartVersion("1.0.0"); err == nil {
+		t.Error("expected an error for a tag that is not a SemVer version")
+	}
+}
+
+func TestVersionChart(t *testing.T) {
+	restore := setDroneEnv(map[string]string{"DRONE_BUILD_EVENT": "push", "DRONE_BUILD_NUMBER": "42", "DRONE_COMMIT_SHA": "0123456789"})
+	defer restore()
+
+	plugin := &Plugin{Config: Config{Chart: "../charts/plugintest", AutoVersion: true}}
+	cleanup, err := versionChart(plugin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copied := plugin.Config.Chart
+
+	if filepath.Base(copied) != "plugintest" || copied == "../charts/plugintest" {
+		t.Errorf("chart has not been copied: %s", copied)
+	}
+	if plugin.Config.Version != "0.1.0-build.42+0123456" || plugin.Config.AppVersion != "0123456" {
+		t.Errorf("unexpected versions %s/%s", plugin.Config.Version, plugin.Config.AppVersion)
+	}
+	metadata, err := loadChartMetadata(copied)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.Name != "plugintest" || metadata.Version != "0.1.0-build.42+0123456" || metadata.AppVersion != "0123456" {
+		t.Errorf("Chart.yaml has not been rewritten: %+v", metadata)
+	}
+	if _, err := os.Stat(filepath.Join(copied, "templates", "NOTES.txt")); err != nil {
+		t.Errorf("templates have not been copied: %v", err)
+	}
+	if original, _ := loadChartMetadata("../charts/plugintest"); original.Version != "0.1.0" {
+		t.Errorf("original Chart.yaml has been modified: %+v", original)
+	}
+
+	cleanup()
+	if _, err := os.Stat(copied); !os.IsNotExist(err) {
+		t.Error("chart copy has not been removed")
+	}
+}
@@ -0,0 +1,168 @@
+package plugin
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// namespaceList is the part of a namespace list the cleanup needs
+type namespaceList struct {
+	Items []struct {
+		Metadata struct {
+			Name              string            `json:"name"`
+			CreationTimestamp string            `json:"creationTimestamp"`
+			Labels            map[string]string `json:"labels"`
+		} `json:"metadata"`
+	} `json:"items"`
+}
+
+func doHelmPurge(p *Plugin, release string) []string {
+	purge := []string{
+		"delete",
+		release,
+		"--purge",
+	}
+	if p.Config.TillerNs != "" {
+		purge = append(purge, "--tiller-namespace")
+		purge = append(purge, p.Config.TillerNs)
+	}
+	return append(purge, tlsFlags(p)...)
+}
+
+// isProtected tells if name matches one of the cleanup_protected patterns
+func isProtected(p *Plugin, name string) bool {
+	for _, pattern := range p.Config.CleanupProtected {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// cleanupReleases removes the releases matching cleanup_pattern that have
+// not been deployed for cleanup_ttl, and the namespaces matching
+// cleanup_selector that expired, along with their releases. With dry-run
+// it only lists what would be removed.
+func cleanupReleases(p *Plugin) error {
+	var ttl time.Duration
+	if p.Config.CleanupTTL != "" {
+		var err error
+		if ttl, err = time.ParseDuration(p.Config.CleanupTTL); err != nil {
+			return fmt.Errorf("Error: invalid cleanup_ttl %s: %v", p.Config.CleanupTTL, err)
+		}
+	}
+	if p.Config.CleanupPattern != "" && ttl == 0 {
+		return fmt.Errorf("Error: cleanup_ttl is needed to clean up the releases matching cleanup_pattern.")
+	}
+	selector := p.Config.CleanupSelector
+	if selector == "" && p.Config.CleanupPattern == "" {
+		selector = previewLabel + "=true"
+	}
+	now := time.Now()
+
+	releases, err := listReleases(p)
+	if err != nil {
+		return err
+	}
+	stale := []string{}
+
+	if p.Config.CleanupPattern != "" {
+		pattern, err := regexp.Compile(p.Config.CleanupPattern)
+		if err != nil {
+			return fmt.Errorf("Error: invalid cleanup_pattern %s: %v", p.Config.CleanupPattern, err)
+		}
+		for _, release := range releases {
+			if !pattern.MatchString(release.Name) || isProtected(p, release.Name) {
+				continue
+			}
+			updated, err := parseHelmTime(release.Updated)
+			if err != nil {
+				return fmt.Errorf("Error reading release %s: %v", release.Name, err)
+			}
+			if now.Sub(updated) > ttl {
+				fmt.Printf("release %s was last deployed %s ago\n", release.Name, now.Sub(updated).Round(time.Minute))
+				stale = append(stale, release.Name)
+			}
+		}
+	}
+
+	namespaces := []string{}
+	var kube *kubeClient
+	if selector != "" {
+		kube, err = newKubeClient(p)
+		if err != nil {
+			return err
+		}
+		list := namespaceList{}
+		if err := kube.get("/api/v1/namespaces?labelSelector="+url.QueryEscape(selector), &list); err != nil {
+			return fmt.Errorf("Error listing namespaces: %v", err)
+		}
+		for _, item := range list.Items {
+			name := item.Metadata.Name
+			if isProtected(p, name) {
+				continue
+			}
+			expired := false
+			if expires, err := strconv.ParseInt(item.Metadata.Labels[previewExpiresLabel], 10, 64); err == nil {
+				expired = now.After(time.Unix(expires, 0))
+			} else if created, err := time.Parse(time.RFC3339, item.Metadata.CreationTimestamp); err == nil && ttl > 0 {
+				expired = now.Sub(created) > ttl
+			}
+			if !expired {
+				continue
+			}
+			// deleting the namespace would remove the protected releases too
+			held := []string{}
+			protected := false
+			for _, release := range releases {
+				if release.Namespace != name {
+					continue
+				}
+				if isProtected(p, release.Name) {
+					fmt.Printf("namespace %s has expired but holds protected release %s\n", name, release.Name)
+					protected = true
+					break
+				}
+				held = append(held, release.Name)
+			}
+			if protected {
+				continue
+			}
+			fmt.Printf("namespace %s has expired\n", name)
+			namespaces = append(namespaces, name)
+			for _, release := range held {
+				if !containsString(stale, release) {
+					stale = append(stale, release)
+				}
+			}
+		}
+	}
+
+	if p.Config.DryRun {
+		for _, release := range stale {
+			fmt.Println("would delete release " + release)
+		}
+		for _, namespace := range namespaces {
+			fmt.Println("would delete namespace " + namespace)
+		}
+		return nil
+	}
+
+	for _, release := range stale {
+		fmt.Println("deleting release " + release)
+		if err := runCommand(doHelmPurge(p, release)); err != nil {
+			return fmt.Errorf("Error deleting release %s: %v", release, err)
+		}
+	}
+	for _, namespace := range namespaces {
+		fmt.Println("deleting namespace " + namespace)
+		if err := kube.remove("/api/v1/namespaces/" + namespace); err != nil && !isNotFound(err) {
+			return fmt.Errorf("Error deleting namespace %s: %v", namespace, err)
+		}
+	}
+	return nil
+}
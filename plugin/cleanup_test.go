@@ -0,0 +1,115 @@
+package plugin
+
+import (
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCleanupReleases(t *testing.T) {
+	api, server := newFakeKubeAPI()
+	defer server.Close()
+
+	expired := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	valid := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	for name, expires := range map[string]string{"app-pr-1": expired, "app-pr-2": valid, "app-pr-3": expired, "app-pr-4": expired} {
+		api.objects["/api/v1/namespaces/"+name] = map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"name":   name,
+				"labels": map[string]interface{}{previewLabel: "true", previewExpiresLabel: expires},
+			},
+		}
+	}
+	api.objects["/api/v1/namespaces/production"] = map[string]interface{}{
+		"metadata": map[string]interface{}{"name": "production"},
+	}
+
+	old := time.Now().Add(-48 * time.Hour).Format(time.ANSIC)
+	recent := time.Now().Add(-time.Hour).Format(time.ANSIC)
+	calls, restore := fakeHelm(t, `[ "$1" = list ] && cat <<EOF
+{"Releases":[
+{"Name":"app-pr-1","Namespace":"app-pr-1","Updated":"`+recent+`"},
+{"Name":"app-pr-2","Namespace":"app-pr-2","Updated":"`+recent+`"},
+{"Name":"app-pr-3","Namespace":"app-pr-3","Updated":"`+recent+`"},
+{"Name":"app-pr-4","Namespace":"app-pr-4","Updated":"`+recent+`"},
+{"Name":"demo-keep","Namespace":"app-pr-4","Updated":"`+recent+`"},
+{"Name":"feature-old","Namespace":"feature","Updated":"`+old+`"},
+{"Name":"feature-new","Namespace":"feature","Updated":"`+recent+`"},
+{"Name":"feature-keep","Namespace":"feature","Updated":"`+old+`"},
+{"Name":"production","Namespace":"production","Updated":"`+old+`"}
+]}
+EOF
+exit 0`)
+	defer restore()
+
+	plugin := &Plugin{
+		Config: Config{
+			APIServer:        server.URL,
+			TillerNs:         "tiller",
+			HelmCommand:      "cleanup",
+			CleanupTTL:       "24h",
+			CleanupPattern:   "^feature-",
+			CleanupSelector:  previewLabel + "=true",
+			CleanupProtected: []string{"*-keep", "app-pr-3"},
+		},
+	}
+	if err := cleanupReleases(plugin); err != nil {
+		t.Fatal(err)
+	}
+
+	data, _ := ioutil.ReadFile(calls)
+	expected := "list --all --output json --tiller-namespace tiller\n" +
+		"delete feature-old --purge --tiller-namespace tiller\n" +
+		"delete app-pr-1 --purge --tiller-namespace tiller\n"
+	if string(data) != expected {
+		t.Errorf("unexpected helm calls:\n%s", data)
+	}
+	for name, kept := range map[string]bool{"app-pr-1": false, "app-pr-2": true, "app-pr-3": true, "app-pr-4": true, "production": true} {
+		if _, ok := api.objects["/api/v1/namespaces/"+name]; ok != kept {
+			t.Errorf("namespace %s kept: %v, expected %v", name, ok, kept)
+		}
+	}
+}
+
+func TestCleanupReleasesDryRun(t *testing.T) {
+	api, server := newFakeKubeAPI()
+	defer server.Close()
+
+	api.objects["/api/v1/namespaces/app-pr-1"] = map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"name":   "app-pr-1",
+			"labels": map[string]interface{}{previewLabel: "true", previewExpiresLabel: "1"},
+		},
+	}
+	calls, restore := fakeHelm(t, `[ "$1" = list ] && echo '[{"Name":"app-pr-1","Namespace":"app-pr-1"}]'
+exit 0`)
+	defer restore()
+
+	plugin := &Plugin{Config: Config{APIServer: server.URL, DryRun: true}}
+	if err := cleanupReleases(plugin); err != nil {
+		t.Fatal(err)
+	}
+
+	data, _ := ioutil.ReadFile(calls)
+	if strings.Contains(string(data), "delete") {
+		t.Errorf("dry-run should not delete releases:\n%s", data)
+	}
+	if _, ok := api.objects["/api/v1/namespaces/app-pr-1"]; !ok {
+		t.Error("dry-run should not delete namespaces")
+	}
+}
+
+func TestCleanupPatternNeedsTTL(t *testing.T) {
+	calls, restore := fakeHelm(t, "exit 0")
+	defer restore()
+
+	plugin := &Plugin{Config: Config{CleanupPattern: "^feature-"}}
+	if err := cleanupReleases(plugin); err == nil {
+		t.Error("expected an error when cleanup_pattern is set without cleanup_ttl")
+	}
+	if data, _ := ioutil.ReadFile(calls); len(data) > 0 {
+		t.Errorf("helm should not have been called:\n%s", data)
+	}
+}
@@ -0,0 +1,219 @@
+package plugin
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultDiagnosticsFile     = "helm-diagnostics.txt"
+	defaultDiagnosticsLogLines = 50
+)
+
+// labels charts use to tell which release a pod belongs to
+var releaseLabels = []string{"release", "app.kubernetes.io/instance"}
+
+// env vars whose name contains one of these are redacted from diagnostics
+var secretEnvNames = regexp.MustCompile(`(?i)password|secret|token|key`)
+
+// key=value and key: value pairs that look like credentials
+var secretPairs = regexp.MustCompile(`(?i)((?:password|passwd|secret|token|api[_-]?key)["']?\s*[:=]\s*["']?)[^\s"',]+`)
+
+type eventList struct {
+	Items []struct {
+		Type           string `json:"type"`
+		Reason         string `json:"reason"`
+		Message        string `json:"message"`
+		Count          int    `json:"count"`
+		LastTimestamp  string `json:"lastTimestamp"`
+		InvolvedObject struct {
+			Kind string `json:"kind"`
+			Name string `json:"name"`
+		} `json:"involvedObject"`
+	} `json:"items"`
+}
+
+type diagnosticPod struct {
+	Metadata struct {
+		Name string `json:"name"`
+	} `json:"metadata"`
+	Status struct {
+		Phase             string `json:"phase"`
+		ContainerStatuses []struct {
+			Name         string `json:"name"`
+			Ready        bool   `json:"ready"`
+			RestartCount int    `json:"restartCount"`
+			State        struct {
+				Waiting *struct {
+					Reason string `json:"reason"`
+				} `json:"waiting"`
+				Terminated *struct {
+					Reason   string `json:"reason"`
+					ExitCode int    `json:"exitCode"`
+				} `json:"terminated"`
+			} `json:"state"`
+		} `json:"containerStatuses"`
+	} `json:"status"`
+}
+
+// collectDiagnostics gathers the namespace events, the release pods and
+// the logs of their crashing containers after a failed deploy. They are
+// printed, with anything looking like a secret redacted, and saved to
+// diagnostics_file. Diagnostics are best effort: errors are only printed.
+func collectDiagnostics(p *Plugin) {
+	kube, err := newKubeClient(p)
+	if err != nil {
+		fmt.Printf("Error collecting diagnostics: %v\n", err)
+		return
+	}
+	namespace := p.Config.Namespace
+	if namespace == "" {
+		namespace = "default"
+	}
+
+	report := &bytes.Buffer{}
+	writeEvents(report, kube, namespace)
+	writePods(report, kube, p, namespace)
+
+	diagnostics := redact(p, report.String())
+	fmt.Println("==== diagnostics for release " + p.Config.Release + " ====")
+	fmt.Print(diagnostics)
+
+	file := p.Config.DiagnosticsFile
+	if file == "" {
+		file = defaultDiagnosticsFile
+	}
+	if err := ioutil.WriteFile(file, []byte(diagnostics), 0644); err != nil {
+		fmt.Printf("Error writing diagnostics to %s: %v\n", file, err)
+	}
+}
+
+func writeEvents(report *bytes.Buffer, kube *kubeClient, namespace string) {
+	fmt.Fprintf(report, "\n## events in namespace %s\n", namespace)
+	events := eventList{}
+	if err := kube.get(namespacedPath("/api/v1", namespace, "events"), &events); err != nil {
+		fmt.Fprintf(report, "Error listing events: %v\n", err)
+		return
+	}
+	sort.SliceStable(events.Items, func(i, j int) bool {
+		return events.Items[i].LastTimestamp < events.Items[j].LastTimestamp
+	})
+	for _, event := range events.Items {
+		fmt.Fprintf(report, "%s %s %s %s/%s (x%d): %s\n", event.LastTimestamp, event.Type, event.Reason,
+			strings.ToLower(event.InvolvedObject.Kind), event.InvolvedObject.Name, event.Count, event.Message)
+	}
+}
+
+func writePods(report *bytes.Buffer, kube *kubeClient, p *Plugin, namespace string) {
+	fmt.Fprintf(report, "\n## pods of release %s\n", p.Config.Release)
+	pods, err := releasePods(kube, namespace, p.Config.Release)
+	if err != nil {
+		fmt.Fprintf(report, "Error listing pods: %v\n", err)
+		return
+	}
+
+	lines := p.Config.DiagnosticsLogLines
+	if lines <= 0 {
+		lines = defaultDiagnosticsLogLines
+	}
+	crashing := []string{}
+	for _, pod := range pods {
+		fmt.Fprintf(report, "pod/%s %s\n", pod.Metadata.Name, pod.Status.Phase)
+		for _, container := range pod.Status.ContainerStatuses {
+			state := "running"
+			if waiting := container.State.Waiting; waiting != nil {
+				state = "waiting: " + waiting.Reason
+			} else if terminated := container.State.Terminated; terminated != nil {
+				state = fmt.Sprintf("terminated: %s (exit code %d)", terminated.Reason, terminated.ExitCode)
+			}
+			fmt.Fprintf(report, "  %s ready=%v restarts=%d %s\n", container.Name, container.Ready, container.RestartCount, state)
+			if !container.Ready && (container.RestartCount > 0 || container.State.Terminated != nil) {
+				crashing = append(crashing, pod.Metadata.Name+"/"+container.Name)
+				query := url.Values{}
+				query.Set("container", container.Name)
+				query.Set("tailLines", strconv.Itoa(lines))
+				query.Set("previous", strconv.FormatBool(container.RestartCount > 0 && container.State.Terminated == nil))
+				writeLogs(report, kube, namespacedPath("/api/v1", namespace, "pods")+"/"+pod.Metadata.Name+"/log?"+query.Encode(), pod.Metadata.Name, container.Name)
+			}
+		}
+	}
+	if len(pods) == 0 {
+		fmt.Fprintln(report, "no pod found")
+	}
+}
+
+func writeLogs(report *bytes.Buffer, kube *kubeClient, path string, pod string, container string) {
+	fmt.Fprintf(report, "\n## logs of %s/%s\n", pod, container)
+	logs := []byte{}
+	if err := kube.get(path, &logs); err != nil {
+		fmt.Fprintf(report, "Error reading logs: %v\n", err)
+		return
+	}
+	report.Write(logs)
+	if len(logs) > 0 && logs[len(logs)-1] != '\n' {
+		report.WriteByte('\n')
+	}
+}
+
+// releasePods returns the pods labelled with the release name, whichever
+// labelling convention the chart follows
+func releasePods(kube *kubeClient, namespace string, release string) ([]diagnosticPod, error) {
+	pods := []diagnosticPod{}
+	seen := map[string]bool{}
+	for _, label := range releaseLabels {
+		list := struct {
+			Items []diagnosticPod `json:"items"`
+		}{}
+		selector := url.QueryEscape(label + "=" + release)
+		if err := kube.get(namespacedPath("/api/v1", namespace, "pods")+"?labelSelector="+selector, &list); err != nil {
+			return nil, err
+		}
+		for _, pod := range list.Items {
+			if !seen[pod.Metadata.Name] {
+				seen[pod.Metadata.Name] = true
+				pods = append(pods, pod)
+			}
+		}
+	}
+	return pods, nil
+}
+
+// isSecretName tells if the env var name is one of the secrets, which are
+// listed in lowercase, e.g. prod_api_server
+func isSecretName(p *Plugin, name string) bool {
+	for _, secret := range p.Config.Secrets {
+		if strings.EqualFold(secret, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// values shorter than this are not redacted, e.g. a port or a flag
+const minRedactLength = 6
+
+// redact hides the plugin credentials, secret env vars, the secrets read
+// from Vault and anything that looks like a password or a token
+func redact(p *Plugin, s string) string {
+	values := []string{p.Config.Token, p.Config.Certificate}
+	for _, e := range os.Environ() {
+		kv := strings.SplitN(e, "=", 2)
+		if len(kv) == 2 && (secretEnvNames.MatchString(kv[0]) || isSecretName(p, kv[0])) {
+			values = append(values, kv[1])
+		}
+	}
+	for _, value := range append(values, p.secrets...) {
+		// short values would redact unrelated text
+		if len(value) >= minRedactLength {
+			s = strings.Replace(s, value, "********", -1)
+		}
+	}
+	return secretPairs.ReplaceAllString(s, "${1}********")
+}
@@ -0,0 +1,94 @@
+package plugin
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCollectDiagnostics(t *testing.T) {
+	api, server := newFakeKubeAPI()
+	defer server.Close()
+
+	api.objects["/api/v1/namespaces/web/events/app.1"] = map[string]interface{}{
+		"metadata":       map[string]interface{}{"name": "app.1"},
+		"type":           "Warning",
+		"reason":         "BackOff",
+		"message":        "Back-off restarting failed container",
+		"count":          3,
+		"lastTimestamp":  "2019-01-08T10:00:00Z",
+		"involvedObject": map[string]interface{}{"kind": "Pod", "name": "app-1"},
+	}
+	api.objects["/api/v1/namespaces/web/pods/app-1"] = map[string]interface{}{
+		"metadata": map[string]interface{}{"name": "app-1", "labels": map[string]interface{}{"release": "app"}},
+		"status": map[string]interface{}{
+			"phase": "Running",
+			"containerStatuses": []interface{}{map[string]interface{}{
+				"name":         "app",
+				"restartCount": 3,
+				"state":        map[string]interface{}{"waiting": map[string]interface{}{"reason": "CrashLoopBackOff"}},
+			}},
+		},
+	}
+	api.objects["/api/v1/namespaces/web/pods/other"] = map[string]interface{}{
+		"metadata": map[string]interface{}{"name": "other", "labels": map[string]interface{}{"release": "other"}},
+	}
+	api.raw["/api/v1/namespaces/web/pods/app-1/log"] = "connecting with DB_PASSWORD=hunter2hunter2\nusing token secret-token-value\npanic: connection refused\n"
+
+	dir, err := ioutil.TempDir("", "diagnostics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	plugin := &Plugin{
+		Config: Config{
+			APIServer:       server.URL,
+			Token:           "secret-token-value",
+			Release:         "app",
+			Namespace:       "web",
+			DiagnosticsFile: filepath.Join(dir, "diagnostics.txt"),
+		},
+	}
+	collectDiagnostics(plugin)
+
+	data, err := ioutil.ReadFile(plugin.Config.DiagnosticsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diagnostics := string(data)
+	for _, expected := range []string{
+		"Warning BackOff pod/app-1 (x3): Back-off restarting failed container",
+		"app ready=false restarts=3 waiting: CrashLoopBackOff",
+		"panic: connection refused",
+		"DB_PASSWORD=********",
+	} {
+		if !strings.Contains(diagnostics, expected) {
+			t.Errorf("diagnostics should contain %q:\n%s", expected, diagnostics)
+		}
+	}
+	for _, unexpected := range []string{"hunter2", "secret-token-value", "pod/other"} {
+		if strings.Contains(diagnostics, unexpected) {
+			t.Errorf("diagnostics should not contain %q:\n%s", unexpected, diagnostics)
+		}
+	}
+}
+
+func TestRedact(t *testing.T) {
+	os.Setenv("TEST_DIAGNOSTICS_API_KEY", "abcdef123456")
+	defer os.Unsetenv("TEST_DIAGNOSTICS_API_KEY")
+
+	redacted := redact(&Plugin{}, `key abcdef123456, "password": "s3cr3t", user=admin`)
+	if redacted != `key ********, "password": "********", user=admin` {
+		t.Errorf("unexpected redacted text %s", redacted)
+	}
+
+	os.Setenv("PROD_API_SERVER", "https://10.0.0.1:6443")
+	defer os.Unsetenv("PROD_API_SERVER")
+	redacted = redact(&Plugin{Config: Config{Secrets: []string{"prod_api_server"}}}, "dial https://10.0.0.1:6443: timeout")
+	if redacted != "dial ********: timeout" {
+		t.Errorf("secret prod_api_server not redacted: %s", redacted)
+	}
+}
@@ -0,0 +1,188 @@
+package plugin
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+var AWS_IAM_AUTHENTICATOR_BIN = "/bin/aws-iam-authenticator"
+
+// kubeClient is a minimal client for the Kubernetes REST API, using the same
+// credentials the plugin renders into the kubeconfig
+type kubeClient struct {
+	server string
+	token  string
+	client *http.Client
+}
+
+// kubeError is returned when the API server answers with an error status
+type kubeError struct {
+	Code    int
+	Message string
+}
+
+func (e *kubeError) Error() string {
+	return fmt.Sprintf("kubernetes API returned %d: %s", e.Code, e.Message)
+}
+
+func isNotFound(err error) bool {
+	kerr, ok := err.(*kubeError)
+	return ok && kerr.Code == http.StatusNotFound
+}
+
+// newKubeClient creates a client for the configured API server
+func newKubeClient(p *Plugin) (*kubeClient, error) {
+	resolveKubeSecrets(p)
+	if p.Config.APIServer == "" {
+		return nil, fmt.Errorf("Error: API Server is needed to talk to Kubernetes.")
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: p.Config.SkipTLSVerify}
+	if p.Config.Certificate != "" && !p.Config.SkipTLSVerify {
+		ca, err := base64.StdEncoding.DecodeString(p.Config.Certificate)
+		if err != nil {
+			return nil, fmt.Errorf("Error decoding Kubernetes certificate: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("Error: Kubernetes certificate is not a valid PEM certificate")
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	token := p.Config.Token
+	if token == "" && p.Config.EKSCluster != "" {
+		var err error
+		if token, err = eksToken(p.Config.EKSCluster, p.Config.EKSRoleARN); err != nil {
+			return nil, err
+		}
+	}
+
+	return &kubeClient{
+		server: strings.TrimSuffix(p.Config.APIServer, "/"),
+		token:  token,
+		client: &http.Client{
+			Timeout:   30 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		},
+	}, nil
+}
+
+// eksToken asks aws-iam-authenticator for a token, as the kubeconfig does
+func eksToken(cluster string, role string) (string, error) {
+	args := []string{"token", "-i", cluster}
+	if role != "" {
+		args = append(args, "-r", role)
+	}
+	out, err := exec.Command(AWS_IAM_AUTHENTICATOR_BIN, args...).Output()
+	if err != nil {
+		return "", fmt.Errorf("Error getting EKS token: %v", err)
+	}
+	var credential struct {
+		Status struct {
+			Token string `json:"token"`
+		} `json:"status"`
+	}
+	if err := json.Unmarshal(out, &credential); err != nil {
+		return "", fmt.Errorf("Error parsing EKS token: %v", err)
+	}
+	return credential.Status.Token, nil
+}
+
+func (k *kubeClient) do(method string, path string, in interface{}, out interface{}) error {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, k.server+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if k.token != "" {
+		req.Header.Set("Authorization", "Bearer "+k.token)
+	}
+
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		status := struct {
+			Message string `json:"message"`
+		}{}
+		if json.Unmarshal(data, &status) != nil || status.Message == "" {
+			status.Message = strings.TrimSpace(string(data))
+		}
+		return &kubeError{Code: resp.StatusCode, Message: status.Message}
+	}
+	if raw, ok := out.(*[]byte); ok {
+		*raw = data
+		return nil
+	}
+	if out != nil && len(data) > 0 {
+		return json.Unmarshal(data, out)
+	}
+	return nil
+}
+
+// get decodes the object at path into out, or stores the raw body when out
+// is a *[]byte, e.g. for pod logs
+func (k *kubeClient) get(path string, out interface{}) error {
+	return k.do(http.MethodGet, path, nil, out)
+}
+
+func (k *kubeClient) create(path string, obj interface{}) error {
+	return k.do(http.MethodPost, path, obj, nil)
+}
+
+func (k *kubeClient) update(path string, obj interface{}) error {
+	return k.do(http.MethodPut, path, obj, nil)
+}
+
+func (k *kubeClient) remove(path string) error {
+	return k.do(http.MethodDelete, path, nil, nil)
+}
+
+// apply creates the named object in the collection, or replaces it if it
+// already exists
+func (k *kubeClient) apply(collection string, name string, obj map[string]interface{}) error {
+	existing := map[string]interface{}{}
+	err := k.get(collection+"/"+name, &existing)
+	if isNotFound(err) {
+		return k.create(collection, obj)
+	}
+	if err != nil {
+		return err
+	}
+	if metadata, ok := existing["metadata"].(map[string]interface{}); ok {
+		obj["metadata"].(map[string]interface{})["resourceVersion"] = metadata["resourceVersion"]
+	}
+	return k.update(collection+"/"+name, obj)
+}
+
+// namespacedPath returns the API path of a namespaced collection, e.g.
+// namespacedPath("/apis/apps/v1", "default", "deployments")
+func namespacedPath(group string, namespace string, resource string) string {
+	return fmt.Sprintf("%s/namespaces/%s/%s", group, namespace, resource)
+}
@@ -0,0 +1,167 @@
+package plugin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeKubeAPI is a tiny in-memory stand-in for the Kubernetes API server,
+// storing objects by their path
+type fakeKubeAPI struct {
+	sync.Mutex
+	objects  map[string]map[string]interface{}
+	raw      map[string]string
+	requests []string
+}
+
+func newFakeKubeAPI() (*fakeKubeAPI, *httptest.Server) {
+	api := &fakeKubeAPI{objects: map[string]map[string]interface{}{}, raw: map[string]string{}}
+	return api, httptest.NewServer(api)
+}
+
+func (f *fakeKubeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+
+	w.Header().Set("Content-Type", "application/json")
+	switch r.Method {
+	case http.MethodGet:
+		if body, ok := f.raw[r.URL.Path]; ok {
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte(body))
+			return
+		}
+		if obj, ok := f.objects[r.URL.Path]; ok {
+			json.NewEncoder(w).Encode(obj)
+			return
+		}
+		if !isCollectionPath(r.URL.Path) {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"message": r.URL.Path + " not found"})
+			return
+		}
+		items := []interface{}{}
+		for path, obj := range f.objects {
+			if strings.HasPrefix(path, r.URL.Path+"/") && !strings.Contains(strings.TrimPrefix(path, r.URL.Path+"/"), "/") &&
+				matchesSelector(obj, r.URL.Query().Get("labelSelector")) {
+				items = append(items, obj)
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"items": items})
+	case http.MethodPost:
+		obj := map[string]interface{}{}
+		json.NewDecoder(r.Body).Decode(&obj)
+		name := obj["metadata"].(map[string]interface{})["name"].(string)
+		path := r.URL.Path + "/" + name
+		if _, ok := f.objects[path]; ok {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(map[string]string{"message": name + " already exists"})
+			return
+		}
+		obj["metadata"].(map[string]interface{})["resourceVersion"] = "1"
+		f.objects[path] = obj
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(obj)
+	case http.MethodPut:
+		obj := map[string]interface{}{}
+		json.NewDecoder(r.Body).Decode(&obj)
+		if _, ok := f.objects[r.URL.Path]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		f.objects[r.URL.Path] = obj
+		json.NewEncoder(w).Encode(obj)
+	case http.MethodDelete:
+		if _, ok := f.objects[r.URL.Path]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		delete(f.objects, r.URL.Path)
+		w.Write([]byte("{}"))
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// matchesSelector supports the key=value and key label selectors
+func matchesSelector(obj map[string]interface{}, selector string) bool {
+	if selector == "" {
+		return true
+	}
+	metadata, _ := obj["metadata"].(map[string]interface{})
+	labels, _ := metadata["labels"].(map[string]interface{})
+	for _, requirement := range strings.Split(selector, ",") {
+		parts := strings.SplitN(requirement, "=", 2)
+		value, ok := labels[parts[0]]
+		if !ok || (len(parts) == 2 && value != parts[1]) {
+			return false
+		}
+	}
+	return true
+}
+
+// isCollectionPath tells collections from objects: core API collections
+// have an odd number of segments (/api/v1/namespaces), group ones an even
+// number (/apis/apps/v1/namespaces/default/deployments)
+func isCollectionPath(path string) bool {
+	segments := len(strings.Split(strings.Trim(path, "/"), "/"))
+	if strings.HasPrefix(path, "/api/") {
+		return segments%2 == 1
+	}
+	return segments%2 == 0
+}
+
+func TestKubeClientApply(t *testing.T) {
+	api, server := newFakeKubeAPI()
+	defer server.Close()
+
+	kube, err := newKubeClient(&Plugin{Config: Config{APIServer: server.URL, Token: "secret-token"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj := map[string]interface{}{
+		"metadata": map[string]interface{}{"name": "test"},
+		"data":     map[string]interface{}{"key": "first"},
+	}
+	if err := kube.apply("/api/v1/namespaces/default/configmaps", "test", obj); err != nil {
+		t.Fatal(err)
+	}
+	obj["data"] = map[string]interface{}{"key": "second"}
+	if err := kube.apply("/api/v1/namespaces/default/configmaps", "test", obj); err != nil {
+		t.Fatal(err)
+	}
+
+	stored := api.objects["/api/v1/namespaces/default/configmaps/test"]
+	if stored["data"].(map[string]interface{})["key"] != "second" {
+		t.Errorf("apply did not update the existing object: %v", stored)
+	}
+	if stored["metadata"].(map[string]interface{})["resourceVersion"] != "1" {
+		t.Errorf("apply did not keep the resource version: %v", stored)
+	}
+}
+
+func TestKubeClientError(t *testing.T) {
+	_, server := newFakeKubeAPI()
+	defer server.Close()
+
+	kube, err := newKubeClient(&Plugin{Config: Config{APIServer: server.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = kube.get("/api/v1/namespaces/missing", nil)
+	if !isNotFound(err) {
+		t.Errorf("expected a not found error, got %v", err)
+	}
+}
+
+func TestKubeClientNeedsAPIServer(t *testing.T) {
+	_, err := newKubeClient(&Plugin{Config: Config{Prefix: "NOPE"}})
+	if err == nil {
+		t.Error("expected an error when no API server is configured")
+	}
+}
@@ -0,0 +1,247 @@
+package plugin
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	defaultLockTimeout = "10m"
+	defaultLockTTL     = "30m"
+	leaseTimeFormat    = "2006-01-02T15:04:05.000000Z07:00"
+)
+
+// how often a held lock is checked again while waiting for it
+var lockPollInterval = 5 * time.Second
+
+// shortest lock_ttl, leaving the lock time to be renewed
+var minLockTTL = 3 * time.Second
+
+// lease is the part of a coordination.k8s.io Lease used as a release lock
+type lease struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Metadata   struct {
+		Name            string `json:"name"`
+		Namespace       string `json:"namespace"`
+		ResourceVersion string `json:"resourceVersion,omitempty"`
+	} `json:"metadata"`
+	Spec struct {
+		HolderIdentity       string `json:"holderIdentity"`
+		LeaseDurationSeconds int    `json:"leaseDurationSeconds"`
+		AcquireTime          string `json:"acquireTime,omitempty"`
+		RenewTime            string `json:"renewTime,omitempty"`
+	} `json:"spec"`
+}
+
+// expired tells if the holder of the lease stopped renewing it
+func (l *lease) expired(now time.Time) bool {
+	renewed, err := time.Parse(leaseTimeFormat, l.Spec.RenewTime)
+	if err != nil {
+		return true
+	}
+	return now.After(renewed.Add(time.Duration(l.Spec.LeaseDurationSeconds) * time.Second))
+}
+
+// releaseLock is a lease held on a release while it is being changed
+type releaseLock struct {
+	kube        *kubeClient
+	path        string
+	name        string
+	releaseName string
+	owner       string
+	ttl         time.Duration
+	done        chan struct{}
+	stopped     sync.WaitGroup
+	mutex       sync.Mutex
+	lostTo      string
+}
+
+// lockOwner identifies the build holding the lock, by its url if drone
+// gives one
+func lockOwner() string {
+	for _, env := range []string{"DRONE_BUILD_LINK", "CI_BUILD_LINK"} {
+		if link := os.Getenv(env); link != "" {
+			return link
+		}
+	}
+	if repo := os.Getenv("DRONE_REPO"); repo != "" {
+		return repo + "#" + os.Getenv("DRONE_BUILD_NUMBER")
+	}
+	hostname, _ := os.Hostname()
+	return hostname
+}
+
+// lockRelease takes the lock of the release, a Lease named
+// drone-helm-<release> in the tiller namespace, waiting up to
+// lock_timeout for the build holding it. A lock that hasn't been renewed
+// for lock_ttl is taken over. The lock is renewed in the background until
+// it is unlocked.
+func lockRelease(p *Plugin) (*releaseLock, error) {
+	if p.Config.Release == "" {
+		return nil, fmt.Errorf("Error: release is needed to lock it.")
+	}
+	timeout := p.Config.LockTimeout
+	if timeout == "" {
+		timeout = defaultLockTimeout
+	}
+	wait, err := time.ParseDuration(timeout)
+	if err != nil {
+		return nil, fmt.Errorf("Error: invalid lock_timeout %s: %v", timeout, err)
+	}
+	ttl := p.Config.LockTTL
+	if ttl == "" {
+		ttl = defaultLockTTL
+	}
+	duration, err := time.ParseDuration(ttl)
+	if err != nil {
+		return nil, fmt.Errorf("Error: invalid lock_ttl %s: %v", ttl, err)
+	}
+	if duration < minLockTTL {
+		return nil, fmt.Errorf("Error: lock_ttl %s is too short, it has to be at least %s", ttl, minLockTTL)
+	}
+	kube, err := newKubeClient(p)
+	if err != nil {
+		return nil, err
+	}
+
+	namespace := tillerNamespace(p)
+	lock := &releaseLock{
+		kube:        kube,
+		path:        namespacedPath("/apis/coordination.k8s.io/v1", namespace, "leases"),
+		name:        "drone-helm-" + p.Config.Release,
+		releaseName: p.Config.Release,
+		owner:       lockOwner(),
+		ttl:         duration,
+		done:        make(chan struct{}),
+	}
+
+	deadline := time.Now().Add(wait)
+	for {
+		holder, err := lock.acquire()
+		if err != nil {
+			return nil, fmt.Errorf("Error locking release %s: %v", p.Config.Release, err)
+		}
+		if holder == "" {
+			break
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("Error: release %s is still locked by %s after %s", p.Config.Release, holder, timeout)
+		}
+		fmt.Printf("release %s is locked by %s, waiting\n", p.Config.Release, holder)
+		time.Sleep(lockPollInterval)
+	}
+	if p.Config.Debug {
+		fmt.Printf("locked release %s as %s\n", p.Config.Release, lock.owner)
+	}
+
+	lock.stopped.Add(1)
+	go lock.renew()
+	return lock, nil
+}
+
+// renew keeps the lease until the lock is released, or until another build
+// takes it over
+func (l *releaseLock) renew() {
+	defer l.stopped.Done()
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-ticker.C:
+			holder, err := l.acquire()
+			if err != nil {
+				fmt.Printf("Error renewing the lock of %s: %v\n", l.releaseName, err)
+				continue
+			}
+			if holder != "" {
+				fmt.Printf("Error: the lock of %s has been taken over by %s\n", l.releaseName, holder)
+				l.mutex.Lock()
+				l.lostTo = holder
+				l.mutex.Unlock()
+				return
+			}
+		}
+	}
+}
+
+// held fails when another build took the lock over, as both builds may
+// now be changing the release
+func (l *releaseLock) held() error {
+	if l == nil {
+		return nil
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.lostTo != "" {
+		return fmt.Errorf("Error: lost the lock of release %s to %s, check the release before deploying again", l.releaseName, l.lostTo)
+	}
+	return nil
+}
+
+// unlock stops renewing the lock and releases it
+func (l *releaseLock) unlock() {
+	close(l.done)
+	l.stopped.Wait()
+	if err := l.release(); err != nil {
+		fmt.Printf("Error unlocking release %s: %v\n", l.releaseName, err)
+	}
+}
+
+// acquire takes or renews the lease, returning who holds it when it is
+// held by another build. Conflicts with a build updating the lease at the
+// same time are reported as that build holding it.
+func (l *releaseLock) acquire() (string, error) {
+	now := time.Now()
+	current := &lease{}
+	err := l.kube.get(l.path+"/"+l.name, current)
+	if err != nil && !isNotFound(err) {
+		return "", err
+	}
+	exists := err == nil
+	if exists && current.Spec.HolderIdentity != l.owner && !current.expired(now) {
+		return current.Spec.HolderIdentity, nil
+	}
+
+	next := &lease{APIVersion: "coordination.k8s.io/v1", Kind: "Lease"}
+	next.Metadata.Name = l.name
+	next.Spec.HolderIdentity = l.owner
+	next.Spec.LeaseDurationSeconds = int(l.ttl / time.Second)
+	next.Spec.AcquireTime = now.UTC().Format(leaseTimeFormat)
+	next.Spec.RenewTime = next.Spec.AcquireTime
+	if !exists {
+		err = l.kube.create(l.path, next)
+	} else {
+		if current.Spec.HolderIdentity == l.owner {
+			next.Spec.AcquireTime = current.Spec.AcquireTime
+		} else {
+			fmt.Printf("taking over the lock of %s, expired since %s\n", current.Spec.HolderIdentity, current.Spec.RenewTime)
+		}
+		next.Metadata.ResourceVersion = current.Metadata.ResourceVersion
+		err = l.kube.update(l.path+"/"+l.name, next)
+	}
+	if kubeErr, ok := err.(*kubeError); ok && kubeErr.Code == 409 {
+		return "another build", nil
+	}
+	return "", err
+}
+
+// release deletes the lease, unless another build took it over
+func (l *releaseLock) release() error {
+	current := &lease{}
+	err := l.kube.get(l.path+"/"+l.name, current)
+	if isNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if current.Spec.HolderIdentity != l.owner {
+		return nil
+	}
+	return l.kube.remove(l.path + "/" + l.name)
+}
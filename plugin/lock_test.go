@@ -0,0 +1,142 @@
+package plugin
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+const testLeasePath = "/apis/coordination.k8s.io/v1/namespaces/tiller/leases/drone-helm-app"
+
+func TestLockRelease(t *testing.T) {
+	api, server := newFakeKubeAPI()
+	defer server.Close()
+
+	restore := setDroneEnv(map[string]string{"DRONE_BUILD_LINK": "https://drone.example.com/octocat/app/42"})
+	defer restore()
+
+	plugin := &Plugin{Config: Config{APIServer: server.URL, Release: "app", TillerNs: "tiller"}}
+	lock, err := lockRelease(plugin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lease, ok := api.objects[testLeasePath]
+	if !ok {
+		t.Fatal("the lease has not been created")
+	}
+	spec := lease["spec"].(map[string]interface{})
+	if spec["holderIdentity"] != "https://drone.example.com/octocat/app/42" || spec["leaseDurationSeconds"] != float64(1800) {
+		t.Errorf("unexpected lease %v", spec)
+	}
+
+	if err := lock.held(); err != nil {
+		t.Errorf("the lock should still be held: %v", err)
+	}
+	lock.unlock()
+	if _, ok := api.objects[testLeasePath]; ok {
+		t.Error("the lease should have been deleted")
+	}
+}
+
+func TestLockReleaseHeld(t *testing.T) {
+	api, server := newFakeKubeAPI()
+	defer server.Close()
+
+	api.objects[testLeasePath] = map[string]interface{}{
+		"metadata": map[string]interface{}{"name": "drone-helm-app", "resourceVersion": "3"},
+		"spec": map[string]interface{}{
+			"holderIdentity":       "https://drone.example.com/octocat/app/41",
+			"leaseDurationSeconds": 60,
+			"renewTime":            time.Now().UTC().Format(leaseTimeFormat),
+		},
+	}
+	previous := lockPollInterval
+	lockPollInterval = 10 * time.Millisecond
+	defer func() { lockPollInterval = previous }()
+
+	plugin := &Plugin{Config: Config{APIServer: server.URL, Release: "app", TillerNs: "tiller", LockTimeout: "50ms"}}
+	_, err := lockRelease(plugin)
+	if err == nil || !strings.Contains(err.Error(), "locked by https://drone.example.com/octocat/app/41") {
+		t.Fatalf("the lock should be held by the other build, got %v", err)
+	}
+}
+
+func TestLockReleaseTakeover(t *testing.T) {
+	api, server := newFakeKubeAPI()
+	defer server.Close()
+
+	api.objects[testLeasePath] = map[string]interface{}{
+		"metadata": map[string]interface{}{"name": "drone-helm-app", "resourceVersion": "3"},
+		"spec": map[string]interface{}{
+			"holderIdentity":       "https://drone.example.com/octocat/app/41",
+			"leaseDurationSeconds": 60,
+			"renewTime":            time.Now().Add(-time.Hour).UTC().Format(leaseTimeFormat),
+		},
+	}
+	restore := setDroneEnv(map[string]string{"DRONE_BUILD_LINK": "https://drone.example.com/octocat/app/42"})
+	defer restore()
+
+	plugin := &Plugin{Config: Config{APIServer: server.URL, Release: "app", TillerNs: "tiller"}}
+	lock, err := lockRelease(plugin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.unlock()
+
+	lease := api.objects[testLeasePath]
+	if holder := lease["spec"].(map[string]interface{})["holderIdentity"]; holder != "https://drone.example.com/octocat/app/42" {
+		t.Errorf("the expired lock should have been taken over, held by %v", holder)
+	}
+	if version := lease["metadata"].(map[string]interface{})["resourceVersion"]; version != "3" {
+		t.Errorf("the lease should be updated from its resource version, got %v", version)
+	}
+}
+
+func TestLockReleaseLost(t *testing.T) {
+	api, server := newFakeKubeAPI()
+	defer server.Close()
+
+	restore := setDroneEnv(map[string]string{"DRONE_BUILD_LINK": "https://drone.example.com/octocat/app/42"})
+	defer restore()
+
+	previous := minLockTTL
+	minLockTTL = time.Millisecond
+	defer func() { minLockTTL = previous }()
+
+	plugin := &Plugin{Config: Config{APIServer: server.URL, Release: "app", TillerNs: "tiller", LockTTL: "30ms"}}
+	lock, err := lockRelease(plugin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.unlock()
+
+	api.Lock()
+	spec := api.objects[testLeasePath]["spec"].(map[string]interface{})
+	spec["holderIdentity"] = "https://drone.example.com/octocat/app/43"
+	spec["leaseDurationSeconds"] = 60
+	spec["renewTime"] = time.Now().UTC().Format(leaseTimeFormat)
+	api.Unlock()
+
+	deadline := time.Now().Add(time.Second)
+	for lock.held() == nil && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if err := lock.held(); err == nil || !strings.Contains(err.Error(), "app/43") {
+		t.Errorf("the lost lock should be reported, got %v", err)
+	}
+}
+
+func TestLockReleaseTTL(t *testing.T) {
+	api, server := newFakeKubeAPI()
+	defer server.Close()
+
+	for _, ttl := range []string{"0s", "-1m", "1ns", "2s"} {
+		plugin := &Plugin{Config: Config{APIServer: server.URL, Release: "app", TillerNs: "tiller", LockTTL: ttl}}
+		if _, err := lockRelease(plugin); err == nil || !strings.Contains(err.Error(), "too short") {
+			t.Errorf("lock_ttl %s should be refused, got %v", ttl, err)
+		}
+	}
+	if _, ok := api.objects[testLeasePath]; ok {
+		t.Error("no lease should have been created")
+	}
+}
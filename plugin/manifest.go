@@ -0,0 +1,61 @@
+package plugin
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// manifestResource identifies a resource of a release manifest
+type manifestResource struct {
+	Kind     string `yaml:"kind"`
+	Metadata struct {
+		Name      string `yaml:"name"`
+		Namespace string `yaml:"namespace"`
+	} `yaml:"metadata"`
+}
+
+var documentSeparator = regexp.MustCompile(`(?m)^---.*$`)
+
+func doHelmGetManifest(p *Plugin) []string {
+	get := []string{
+		"get",
+		"manifest",
+		p.Config.Release,
+	}
+	if p.Config.TillerNs != "" {
+		get = append(get, "--tiller-namespace")
+		get = append(get, p.Config.TillerNs)
+	}
+	return append(get, tlsFlags(p)...)
+}
+
+// releaseResources returns the resources deployed by the release
+func releaseResources(p *Plugin) ([]manifestResource, error) {
+	out, err := runCommandOutput(doHelmGetManifest(p))
+	if err != nil {
+		return nil, fmt.Errorf("Error reading manifest of %s: %v", p.Config.Release, err)
+	}
+	return parseManifest(string(out))
+}
+
+// parseManifest splits a multi-document manifest into its resources,
+// skipping empty documents
+func parseManifest(manifest string) ([]manifestResource, error) {
+	resources := []manifestResource{}
+	for _, document := range documentSeparator.Split(manifest, -1) {
+		if strings.TrimSpace(document) == "" {
+			continue
+		}
+		resource := manifestResource{}
+		if err := yaml.Unmarshal([]byte(document), &resource); err != nil {
+			return nil, fmt.Errorf("Error parsing manifest: %v", err)
+		}
+		if resource.Kind != "" {
+			resources = append(resources, resource)
+		}
+	}
+	return resources, nil
+}
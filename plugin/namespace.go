@@ -0,0 +1,115 @@
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// createNamespace makes sure the namespace the release is deployed to
+// exists, with namespace_labels and namespace_annotations set on it
+func createNamespace(p *Plugin) error {
+	if p.Config.Namespace == "" {
+		return fmt.Errorf("Error: namespace is needed to create it.")
+	}
+	labels, err := parseStringMap(p.Config.NamespaceLabels)
+	if err != nil {
+		return fmt.Errorf("Error parsing namespace_labels: %v", err)
+	}
+	annotations, err := parseStringMap(p.Config.NamespaceAnnotations)
+	if err != nil {
+		return fmt.Errorf("Error parsing namespace_annotations: %v", err)
+	}
+
+	if p.Config.Debug {
+		log.Printf("creating namespace %s with labels %v and annotations %v\n", p.Config.Namespace, labels, annotations)
+	}
+	if p.Config.DryRun {
+		return nil
+	}
+	kube, err := newKubeClient(p)
+	if err != nil {
+		return err
+	}
+	if err := ensureNamespace(kube, p.Config.Namespace, labels, annotations); err != nil {
+		return fmt.Errorf("Error creating namespace %s: %v", p.Config.Namespace, err)
+	}
+	return nil
+}
+
+// parseStringMap reads a map given either as a JSON object, which is how
+// drone passes yaml maps to plugins, or as key=value pairs separated by
+// commas, e.g. istio-injection=enabled,team=web
+func parseStringMap(s string) (map[string]string, error) {
+	values := map[string]string{}
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return values, nil
+	}
+	if strings.HasPrefix(s, "{") {
+		err := json.Unmarshal([]byte(s), &values)
+		return values, err
+	}
+	for _, pair := range strings.Split(s, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, fmt.Errorf("%q is not a key=value pair", pair)
+		}
+		values[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return values, nil
+}
+
+// ensureNamespace creates the namespace if it doesn't exist, and sets the
+// given labels and annotations on it, keeping the ones it already has
+func ensureNamespace(kube *kubeClient, name string, labels map[string]string, annotations map[string]string) error {
+	namespace := map[string]interface{}{}
+	err := kube.get("/api/v1/namespaces/"+name, &namespace)
+	if isNotFound(err) {
+		return kube.create("/api/v1/namespaces", map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "Namespace",
+			"metadata": map[string]interface{}{
+				"name":        name,
+				"labels":      labels,
+				"annotations": annotations,
+			},
+		})
+	}
+	if err != nil {
+		return err
+	}
+
+	metadata, _ := namespace["metadata"].(map[string]interface{})
+	if metadata == nil {
+		metadata = map[string]interface{}{"name": name}
+		namespace["metadata"] = metadata
+	}
+	changed := mergeStringMap(metadata, "labels", labels)
+	changed = mergeStringMap(metadata, "annotations", annotations) || changed
+	if !changed {
+		return nil
+	}
+	return kube.update("/api/v1/namespaces/"+name, namespace)
+}
+
+// mergeStringMap sets values in the obj[key] map, telling if it changed
+func mergeStringMap(obj map[string]interface{}, key string, values map[string]string) bool {
+	if len(values) == 0 {
+		return false
+	}
+	existing, _ := obj[key].(map[string]interface{})
+	if existing == nil {
+		existing = map[string]interface{}{}
+		obj[key] = existing
+	}
+	changed := false
+	for k, v := range values {
+		if existing[k] != v {
+			existing[k] = v
+			changed = true
+		}
+	}
+	return changed
+}
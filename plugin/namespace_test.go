@@ -0,0 +1,80 @@
+package plugin
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCreateNamespace(t *testing.T) {
+	api, server := newFakeKubeAPI()
+	defer server.Close()
+
+	plugin := &Plugin{
+		Config: Config{
+			APIServer:            server.URL,
+			Token:                "secret-token",
+			Namespace:            "my-app",
+			CreateNamespace:      true,
+			NamespaceLabels:      `{"istio-injection":"enabled"}`,
+			NamespaceAnnotations: "owner=web-team",
+		},
+	}
+	if err := createNamespace(plugin); err != nil {
+		t.Fatal(err)
+	}
+
+	namespace, ok := api.objects["/api/v1/namespaces/my-app"]
+	if !ok {
+		t.Fatal("namespace has not been created")
+	}
+	metadata := namespace["metadata"].(map[string]interface{})
+	if metadata["labels"].(map[string]interface{})["istio-injection"] != "enabled" {
+		t.Errorf("unexpected labels %v", metadata["labels"])
+	}
+	if metadata["annotations"].(map[string]interface{})["owner"] != "web-team" {
+		t.Errorf("unexpected annotations %v", metadata["annotations"])
+	}
+}
+
+func TestCreateNamespaceKeepsExistingLabels(t *testing.T) {
+	api, server := newFakeKubeAPI()
+	defer server.Close()
+
+	api.objects["/api/v1/namespaces/my-app"] = map[string]interface{}{
+		"metadata": map[string]interface{}{"name": "my-app", "labels": map[string]interface{}{"team": "web"}},
+	}
+	plugin := &Plugin{
+		Config: Config{
+			APIServer:       server.URL,
+			Namespace:       "my-app",
+			CreateNamespace: true,
+			NamespaceLabels: "istio-injection=enabled",
+		},
+	}
+	if err := createNamespace(plugin); err != nil {
+		t.Fatal(err)
+	}
+
+	labels := api.objects["/api/v1/namespaces/my-app"]["metadata"].(map[string]interface{})["labels"]
+	expected := map[string]interface{}{"team": "web", "istio-injection": "enabled"}
+	if !reflect.DeepEqual(labels, expected) {
+		t.Errorf("unexpected labels %v", labels)
+	}
+	if api.requests[len(api.requests)-1] != "PUT /api/v1/namespaces/my-app" {
+		t.Errorf("namespace should have been updated: %v", api.requests)
+	}
+}
+
+func TestParseStringMap(t *testing.T) {
+	values, err := parseStringMap("a=1, b = 2,c=x=y")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"a": "1", "b": "2", "c": "x=y"}
+	if !reflect.DeepEqual(values, expected) {
+		t.Errorf("unexpected map %v", values)
+	}
+	if _, err := parseStringMap("a"); err == nil {
+		t.Error("a value without key=value should be refused")
+	}
+}
@@ -0,0 +1,298 @@
+package plugin
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	ociScheme             = "oci://"
+	ociManifestMediaType  = "application/vnd.oci.image.manifest.v1+json"
+	helmChartMediaType    = "application/vnd.cncf.helm.chart.content.v1.tar+gzip"
+	helmLegacyChartLayer  = "application/tar+gzip"
+	defaultOCICacheFolder = "cache/oci"
+)
+
+// ociRegistry pulls charts stored as OCI artifacts, following the
+// distribution API the same way `helm pull oci://` does
+type ociRegistry struct {
+	scheme   string
+	host     string
+	username string
+	password string
+	token    string
+	client   *http.Client
+}
+
+type ociManifest struct {
+	Layers []struct {
+		MediaType string `json:"mediaType"`
+		Digest    string `json:"digest"`
+	} `json:"layers"`
+}
+
+func isOCI(ref string) bool {
+	return strings.HasPrefix(ref, ociScheme)
+}
+
+// resolveOCIChart expands a chart referenced through an oci helm_repos
+// alias (`name/chart`) to its full oci:// reference and returns the
+// credentials to use for it
+func resolveOCIChart(p *Plugin) (string, *repoConfig, error) {
+	chart := p.Config.Chart
+	for _, repo := range p.Config.HelmRepos {
+		r, err := resolveRepo(p, repo)
+		if err != nil {
+			return "", nil, err
+		}
+		if !isOCI(r.URL) {
+			continue
+		}
+		if strings.HasPrefix(chart, r.Name+"/") {
+			return strings.TrimSuffix(r.URL, "/") + "/" + strings.TrimPrefix(chart, r.Name+"/"), r, nil
+		}
+		if strings.HasPrefix(chart, r.URL+"/") {
+			return chart, r, nil
+		}
+	}
+	if !isOCI(chart) {
+		return chart, nil, nil
+	}
+	return chart, &repoConfig{
+		Username: resolveEnvVar("${REGISTRY_USERNAME}", p.Config.Prefix, p.Config.Debug),
+		Password: resolveEnvVar("${REGISTRY_PASSWORD}", p.Config.Prefix, p.Config.Debug),
+	}, nil
+}
+
+// ociChartCache returns the folder pulled charts are kept in
+func ociChartCache(p *Plugin) string {
+	if p.Config.ChartCache != "" {
+		return p.Config.ChartCache
+	}
+	return filepath.Join(HELM_HOME, defaultOCICacheFolder)
+}
+
+// pullOCIChart downloads the chart into the cache and points the plugin at
+// the local archive. Charts not stored in a registry are left untouched.
+func pullOCIChart(p *Plugin) error {
+	ref, creds, err := resolveOCIChart(p)
+	if err != nil {
+		return err
+	}
+	if !isOCI(ref) {
+		return nil
+	}
+	if p.Config.Version == "" {
+		return fmt.Errorf("Error: chart-version is needed to pull %s", ref)
+	}
+	if p.Config.Verify {
+		return fmt.Errorf("Error: %s has no provenance file to verify, pin its chart_digest instead", ref)
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(ref, ociScheme), "/", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return fmt.Errorf("Invalid OCI chart reference: %s", ref)
+	}
+	host, repository := parts[0], parts[1]
+
+	registry := &ociRegistry{
+		scheme:   "https",
+		host:     host,
+		username: creds.Username,
+		password: creds.Password,
+		client:   &http.Client{Timeout: 60 * time.Second},
+	}
+	if p.Config.RegistryPlainHTTP {
+		registry.scheme = "http"
+	}
+
+	target := filepath.Join(ociChartCache(p), host, filepath.FromSlash(repository), path.Base(repository)+"-"+p.Config.Version+".tgz")
+	if p.Config.Debug {
+		log.Printf("pulling chart %s:%s into %s\n", ref, p.Config.Version, target)
+	}
+	if err := registry.pullChart(repository, p.Config.Version, target); err != nil {
+		return fmt.Errorf("Error pulling chart %s:%s: %v", ref, p.Config.Version, err)
+	}
+	p.Config.Chart = target
+	return nil
+}
+
+// pullChart stores the chart layer of repository:tag in target, unless the
+// cache already holds the same content
+func (r *ociRegistry) pullChart(repository string, tag string, target string) error {
+	manifest := ociManifest{}
+	resp, err := r.get(fmt.Sprintf("/v2/%s/manifests/%s", repository, tag), ociManifestMediaType, repository)
+	if err != nil {
+		return err
+	}
+	err = json.NewDecoder(resp.Body).Decode(&manifest)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("invalid manifest: %v", err)
+	}
+
+	digest := ""
+	for _, layer := range manifest.Layers {
+		if layer.MediaType == helmChartMediaType || layer.MediaType == helmLegacyChartLayer {
+			digest = layer.Digest
+			break
+		}
+	}
+	if digest == "" {
+		return fmt.Errorf("no chart layer in %s:%s", repository, tag)
+	}
+
+	if cached, err := fileDigest(target); err == nil && cached == digest {
+		return nil
+	}
+
+	resp, err = r.get(fmt.Sprintf("/v2/%s/blobs/%s", repository, digest), "", repository)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(target), ".pull-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, hash), resp.Body)
+	tmp.Close()
+	if err != nil {
+		return err
+	}
+	if got := "sha256:" + hex.EncodeToString(hash.Sum(nil)); got != digest {
+		return fmt.Errorf("chart digest is %s, expected %s", got, digest)
+	}
+	return os.Rename(tmp.Name(), target)
+}
+
+// get requests path from the registry, authenticating when challenged
+func (r *ociRegistry) get(path string, accept string, repository string) (*http.Response, error) {
+	resp, err := r.request(path, accept)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusUnauthorized && r.token == "" {
+		challenge := resp.Header.Get("WWW-Authenticate")
+		resp.Body.Close()
+		if err := r.authenticate(challenge, repository); err != nil {
+			return nil, err
+		}
+		if resp, err = r.request(path, accept); err != nil {
+			return nil, err
+		}
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("registry returned %s for %s", resp.Status, path)
+	}
+	return resp, nil
+}
+
+func (r *ociRegistry) request(path string, accept string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, r.scheme+"://"+r.host+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	if r.token != "" {
+		req.Header.Set("Authorization", "Bearer "+r.token)
+	} else if r.username != "" {
+		req.SetBasicAuth(r.username, r.password)
+	}
+	return r.client.Do(req)
+}
+
+var challengeExp = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// authenticate exchanges the credentials for a bearer token when the
+// registry asks for one. Registries using basic auth already got the
+// credentials with the first request.
+func (r *ociRegistry) authenticate(challenge string, repository string) error {
+	if !strings.HasPrefix(strings.ToLower(challenge), "bearer ") {
+		return fmt.Errorf("registry authentication failed")
+	}
+	params := map[string]string{}
+	for _, match := range challengeExp.FindAllStringSubmatch(challenge, -1) {
+		params[match[1]] = match[2]
+	}
+	if params["realm"] == "" {
+		return fmt.Errorf("registry authentication challenge without realm: %s", challenge)
+	}
+	if params["scope"] == "" {
+		params["scope"] = "repository:" + repository + ":pull"
+	}
+
+	query := url.Values{}
+	query.Set("scope", params["scope"])
+	if params["service"] != "" {
+		query.Set("service", params["service"])
+	}
+	req, err := http.NewRequest(http.MethodGet, params["realm"]+"?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	if r.username != "" {
+		req.SetBasicAuth(r.username, r.password)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("registry login returned %s", resp.Status)
+	}
+
+	token := struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return fmt.Errorf("invalid registry token: %v", err)
+	}
+	r.token = token.Token
+	if r.token == "" {
+		r.token = token.AccessToken
+	}
+	if r.token == "" {
+		return fmt.Errorf("registry login returned an empty token")
+	}
+	return nil
+}
+
+// fileDigest returns the sha256 digest of a file in OCI notation
+func fileDigest(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(hash.Sum(nil)), nil
+}
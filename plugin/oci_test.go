@@ -0,0 +1,169 @@
+package plugin
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// chartArchive builds a gzipped chart tarball holding files
+func chartArchive(t *testing.T, files map[string]string) []byte {
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gz)
+	for name, content := range files {
+		hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(content))}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(content))
+	}
+	tw.Close()
+	gz.Close()
+	return buf.Bytes()
+}
+
+// fakeRegistry serves a single chart, asking for a bearer token first
+func fakeRegistry(t *testing.T, repository string, tag string, chart []byte) *httptest.Server {
+	sum := sha256.Sum256(chart)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			user, pass, ok := r.BasicAuth()
+			if !ok || user != "robot" || pass != "s3cr3t" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			if r.URL.Query().Get("scope") != "repository:"+repository+":pull" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]string{"token": "registry-token"})
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer registry-token" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+server.URL+`/token",service="registry"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/v2/" + repository + "/manifests/" + tag:
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"schemaVersion": 2,
+				"layers": []map[string]string{
+					{"mediaType": helmChartMediaType, "digest": digest},
+				},
+			})
+		case "/v2/" + repository + "/blobs/" + digest:
+			w.Write(chart)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	return server
+}
+
+func TestPullOCIChart(t *testing.T) {
+	chart := chartArchive(t, map[string]string{"app/Chart.yaml": "name: app\nversion: 1.2.3\n"})
+	server := fakeRegistry(t, "charts/app", "1.2.3", chart)
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "chart-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	os.Setenv("PROD_REGISTRY_USERNAME", "robot")
+	os.Setenv("PROD_REGISTRY_PASSWORD", "s3cr3t")
+	defer os.Unsetenv("PROD_REGISTRY_USERNAME")
+	defer os.Unsetenv("PROD_REGISTRY_PASSWORD")
+
+	host := strings.TrimPrefix(server.URL, "http://")
+	plugin := &Plugin{
+		Config: Config{
+			Prefix:            "PROD",
+			Chart:             "oci://" + host + "/charts/app",
+			Version:           "1.2.3",
+			ChartCache:        dir,
+			RegistryPlainHTTP: true,
+		},
+	}
+	if err := pullOCIChart(plugin); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := filepath.Join(dir, host, "charts", "app", "app-1.2.3.tgz")
+	if plugin.Config.Chart != expected {
+		t.Errorf("Chart is %s and we expected %s", plugin.Config.Chart, expected)
+	}
+	data, err := ioutil.ReadFile(expected)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, chart) {
+		t.Error("pulled chart differs from the one in the registry")
+	}
+}
+
+func TestPullOCIChartFromRepoAlias(t *testing.T) {
+	chart := chartArchive(t, map[string]string{"app/Chart.yaml": "name: app\nversion: 0.1.0\n"})
+	server := fakeRegistry(t, "team/app", "0.1.0", chart)
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "chart-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	host := strings.TrimPrefix(server.URL, "http://")
+	plugin := &Plugin{
+		Config: Config{
+			HelmRepos:         []string{"team=oci://robot:s3cr3t@" + host + "/team"},
+			Chart:             "team/app",
+			Version:           "0.1.0",
+			ChartCache:        dir,
+			RegistryPlainHTTP: true,
+		},
+	}
+	repoAdd, err := doHelmRepoAdd(plugin, plugin.Config.HelmRepos[0])
+	if err != nil || repoAdd != nil {
+		t.Errorf("OCI repos should not be added to helm, got %v %v", repoAdd, err)
+	}
+	if err := pullOCIChart(plugin); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(plugin.Config.Chart, "app-0.1.0.tgz") {
+		t.Errorf("Chart has not been pulled: %s", plugin.Config.Chart)
+	}
+}
+
+func TestPullOCIChartNeedsVersion(t *testing.T) {
+	plugin := &Plugin{Config: Config{Chart: "oci://registry.example.com/charts/app"}}
+	if err := pullOCIChart(plugin); err == nil {
+		t.Error("expected an error when pulling an OCI chart without version")
+	}
+
+	plugin = &Plugin{Config: Config{Chart: "oci://registry.example.com/charts/app", Version: "1.0.0", Verify: true}}
+	if err := pullOCIChart(plugin); err == nil || !strings.Contains(err.Error(), "chart_digest") {
+		t.Errorf("expected verify to be rejected for OCI charts, got %v", err)
+	}
+
+	plugin = &Plugin{Config: Config{Chart: "./charts/app"}}
+	if err := pullOCIChart(plugin); err != nil || plugin.Config.Chart != "./charts/app" {
+		t.Errorf("local charts should be left untouched, got %s %v", plugin.Config.Chart, err)
+	}
+}
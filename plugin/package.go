@@ -0,0 +1,233 @@
+package plugin
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const defaultPackageDir = "."
+
+// packageDir returns the folder charts are packaged into
+func packageDir(p *Plugin) string {
+	if p.Config.PackageDir != "" {
+		return p.Config.PackageDir
+	}
+	return defaultPackageDir
+}
+
+func keyringFile() string {
+	return filepath.Join(HELM_HOME, "secring.gpg")
+}
+
+func setPackageCommand(p *Plugin) {
+	pkg := make([]string, 2)
+	pkg[0] = "package"
+	pkg[1] = p.Config.Chart
+
+	pkg = append(pkg, "--destination")
+	pkg = append(pkg, packageDir(p))
+	if p.Config.Version != "" {
+		pkg = append(pkg, "--version")
+		pkg = append(pkg, p.Config.Version)
+	}
+	if p.Config.AppVersion != "" {
+		pkg = append(pkg, "--app-version")
+		pkg = append(pkg, p.Config.AppVersion)
+	}
+	if p.Config.UpdateDependencies {
+		pkg = append(pkg, "--dependency-update")
+	}
+	if p.Config.SignKey != "" {
+		pkg = append(pkg, "--sign")
+		pkg = append(pkg, "--key")
+		pkg = append(pkg, p.Config.SignKey)
+		pkg = append(pkg, "--keyring")
+		pkg = append(pkg, keyringFile())
+	}
+	if p.Config.Debug {
+		pkg = append(pkg, "--debug")
+	}
+
+	p.command = pkg
+}
+
+// packagedChart returns the path helm package writes the chart archive to
+func packagedChart(p *Plugin) (string, error) {
+	metadata, err := loadChartMetadata(p.Config.Chart)
+	if err != nil {
+		return "", err
+	}
+	version := metadata.Version
+	if p.Config.Version != "" {
+		version = p.Config.Version
+	}
+	return filepath.Join(packageDir(p), metadata.Name+"-"+version+".tgz"), nil
+}
+
+// publish packages the chart and, for the push command, uploads it to the
+// push_repo. It doesn't need a cluster, only a client side helm.
+func (p *Plugin) publish() error {
+	p.Config.ClientOnly = true
+	init := doHelmInit(p)
+	if err := runCommand(init); err != nil {
+		return fmt.Errorf("Error running helm command: %s", strings.Join(init, " "))
+	}
+	if err := addHelmRepos(p); err != nil {
+		return err
+	}
+
+	if p.Config.SignKey != "" {
+		keyring := resolveEnvVar("${SIGN_KEYRING}", p.Config.Prefix, p.Config.Debug)
+		if keyring == "" {
+			return fmt.Errorf("Error: the SIGN_KEYRING secret is needed to sign the chart.")
+		}
+		if err := writeSecretFile(keyringFile(), decodeKeyring(keyring)); err != nil {
+			return fmt.Errorf("Error writing keyring: %v", err)
+		}
+		defer os.Remove(keyringFile())
+	}
+
+	if p.Config.AutoVersion {
+		cleanup, err := versionChart(p)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+	}
+
+	setPackageCommand(p)
+	if p.Config.Debug {
+		log.Println("helm command: " + strings.Join(p.command, " "))
+	}
+	if err := runCommand(p.command); err != nil {
+		return fmt.Errorf("Error running helm command: %s", strings.Join(p.command, " "))
+	}
+
+	if p.Config.HelmCommand != "push" {
+		return nil
+	}
+	chart, err := packagedChart(p)
+	if err != nil {
+		return err
+	}
+	return pushChart(p, chart)
+}
+
+// decodeKeyring accepts the keyring as is or base64 encoded, as binary
+// keyrings can't be stored in a secret directly
+func decodeKeyring(keyring string) []byte {
+	if strings.Contains(keyring, "-----BEGIN PGP") {
+		return []byte(keyring)
+	}
+	return decodePEM(keyring)
+}
+
+// pushChart uploads a packaged chart, and its provenance file if it has
+// been signed, to the ChartMuseum API of push_repo
+func pushChart(p *Plugin, chart string) error {
+	var repo *repoConfig
+	for _, definition := range p.Config.HelmRepos {
+		r, err := resolveRepo(p, definition)
+		if err != nil {
+			return err
+		}
+		if r.Name == p.Config.PushRepo {
+			repo = r
+		}
+	}
+	if repo == nil {
+		return fmt.Errorf("Error: push_repo %q is not one of the helm_repos", p.Config.PushRepo)
+	}
+
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	files := map[string]string{"chart": chart}
+	if p.Config.SignKey != "" {
+		files["prov"] = chart + ".prov"
+	}
+	for field, path := range files {
+		if err := addFormFile(form, field, path); err != nil {
+			return err
+		}
+	}
+	form.Close()
+
+	target := strings.TrimSuffix(repo.URL, "/") + "/api/charts"
+	if p.Config.Force {
+		target += "?force=true"
+	}
+	req, err := http.NewRequest(http.MethodPost, target, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	if repo.Username != "" {
+		req.SetBasicAuth(repo.Username, repo.Password)
+	}
+
+	client, err := repo.httpClient()
+	if err != nil {
+		return err
+	}
+	if p.Config.Debug {
+		log.Printf("pushing %s to %s\n", chart, target)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Error pushing chart: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("Error pushing chart: %s %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+	return nil
+}
+
+func addFormFile(form *multipart.Writer, field string, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	part, err := form.CreateFormFile(field, filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(part, f)
+	return err
+}
+
+// httpClient returns a client using the repo certificates
+func (r *repoConfig) httpClient() (*http.Client, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: r.InsecureSkipTLSVerify}
+	if r.CACert != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(decodePEM(r.CACert)) {
+			return nil, fmt.Errorf("Error: CA certificate of repo %s is not a valid PEM certificate", r.Name)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if r.Cert != "" && r.Key != "" {
+		cert, err := tls.X509KeyPair(decodePEM(r.Cert), decodePEM(r.Key))
+		if err != nil {
+			return nil, fmt.Errorf("Error loading client certificate of repo %s: %v", r.Name, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return &http.Client{
+		Timeout:   60 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+	}, nil
+}
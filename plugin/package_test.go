@@ -0,0 +1,124 @@
+package plugin
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeHelm replaces HELM_BIN with a shell script, logging every call to
+// the returned file. It returns a function restoring the real binary.
+func fakeHelm(t *testing.T, script string) (string, func()) {
+	dir, err := ioutil.TempDir("", "fake-helm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	calls := filepath.Join(dir, "calls")
+	bin := filepath.Join(dir, "helm")
+	content := "#!/bin/sh\necho \"$@\" >> " + calls + "\n" + script + "\n"
+	if err := ioutil.WriteFile(bin, []byte(content), 0755); err != nil {
+		t.Fatal(err)
+	}
+	previous := HELM_BIN
+	HELM_BIN = bin
+	return calls, func() {
+		HELM_BIN = previous
+		os.RemoveAll(dir)
+	}
+}
+
+func TestGetHelmCommandPackage(t *testing.T) {
+	HELM_HOME = "/root/.helm"
+	plugin := &Plugin{
+		Config: Config{
+			HelmCommand:        "package",
+			Chart:              "./chart/test",
+			PackageDir:         "dist",
+			Version:            "1.2.3",
+			AppVersion:         "abc1234",
+			UpdateDependencies: true,
+			SignKey:            "CI Signing Key",
+		},
+	}
+	setHelmCommand(plugin)
+	res := strings.Join(plugin.command, " ")
+	expected := "package ./chart/test --destination dist --version 1.2.3 --app-version abc1234 --dependency-update --sign --key CI Signing Key --keyring /root/.helm/secring.gpg"
+	if res != expected {
+		t.Errorf("Result is %s and we expected %s", res, expected)
+	}
+}
+
+func TestPublishPush(t *testing.T) {
+	dir, err := ioutil.TempDir("", "package")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	calls, restore := fakeHelm(t, `[ "$1" = "package" ] && echo chart-data > `+dir+`/plugintest-0.2.0.tgz
+exit 0`)
+	defer restore()
+
+	uploaded := ""
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, _ := r.BasicAuth()
+		if user != "publisher" || pass != "s3cr3t" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/api/charts" || r.URL.Query().Get("force") != "true" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		f, header, err := r.FormFile("chart")
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		data, _ := ioutil.ReadAll(f)
+		uploaded = header.Filename + ":" + strings.TrimSpace(string(data))
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"saved":true}`))
+	}))
+	defer server.Close()
+
+	os.Setenv("REPO_CHARTMUSEUM_USERNAME", "publisher")
+	os.Setenv("REPO_CHARTMUSEUM_PASSWORD", "s3cr3t")
+	defer os.Unsetenv("REPO_CHARTMUSEUM_USERNAME")
+	defer os.Unsetenv("REPO_CHARTMUSEUM_PASSWORD")
+
+	plugin := &Plugin{
+		Config: Config{
+			HelmCommand: "push",
+			Chart:       "../charts/plugintest",
+			Version:     "0.2.0",
+			PackageDir:  dir,
+			HelmRepos:   []string{"chartmuseum=" + server.URL},
+			PushRepo:    "chartmuseum",
+			Force:       true,
+		},
+	}
+	if err := plugin.Exec(); err != nil {
+		t.Fatal(err)
+	}
+	if uploaded != "plugintest-0.2.0.tgz:chart-data" {
+		t.Errorf("chart has not been uploaded, got %q", uploaded)
+	}
+
+	data, _ := ioutil.ReadFile(calls)
+	expected := "init --client-only\nrepo add chartmuseum " + server.URL + " --username publisher --password s3cr3t\npackage ../charts/plugintest --destination " + dir + " --version 0.2.0\n"
+	if string(data) != expected {
+		t.Errorf("helm calls are %q and we expected %q", string(data), expected)
+	}
+}
+
+func TestPushChartUnknownRepo(t *testing.T) {
+	plugin := &Plugin{Config: Config{PushRepo: "missing", HelmRepos: []string{"r1=http://r1.example.com"}}}
+	if err := pushChart(plugin, "chart.tgz"); err == nil {
+		t.Error("expected an error when push_repo is not one of the helm_repos")
+	}
+}
@@ -0,0 +1,77 @@
+package plugin
+
+import (
+	"fmt"
+	"strings"
+)
+
+// statuses of a release left behind by an interrupted helm command
+var pendingStatuses = []string{"pending-install", "pending-upgrade", "pending-rollback"}
+
+// releaseStatusName turns helm 2 and helm 3 statuses, e.g. PENDING_UPGRADE
+// or pending-upgrade, into the same name
+func releaseStatusName(status string) string {
+	return strings.Replace(strings.ToLower(status), "_", "-", -1)
+}
+
+// recoverPendingRelease checks the release isn't stuck in a pending state
+// by a build killed while changing it. With pending_recovery: rollback it
+// is rolled back to its last deployed revision, with pending_recovery:
+// fail the build stops, telling how to fix it.
+func recoverPendingRelease(p *Plugin) error {
+	mode := p.Config.PendingRecovery
+	if mode != "rollback" && mode != "fail" {
+		return fmt.Errorf("Error: invalid pending_recovery %s, expected rollback or fail", mode)
+	}
+	releases, err := listReleases(p)
+	if err != nil {
+		return err
+	}
+	status := ""
+	for _, release := range releases {
+		if release.Name == p.Config.Release {
+			status = releaseStatusName(release.Status)
+		}
+	}
+	if !containsString(pendingStatuses, status) {
+		return nil
+	}
+
+	revisions, err := releaseHistory(p, "")
+	if err != nil {
+		return err
+	}
+	pending := releaseRevision{}
+	deployed := releaseRevision{}
+	for _, revision := range revisions {
+		switch releaseStatusName(revision.Status) {
+		case "deployed", "superseded":
+			deployed = revision
+		case status:
+			pending = revision
+		}
+	}
+	if pending.Revision == 0 && len(revisions) > 0 {
+		pending = revisions[len(revisions)-1]
+	}
+	stuck := fmt.Sprintf("release %s is stuck in %s at revision %d since %s, a build was probably interrupted while changing it",
+		p.Config.Release, status, pending.Revision, pending.Updated)
+
+	if deployed.Revision == 0 {
+		return fmt.Errorf("Error: %s, and it has no deployed revision to roll back to. "+
+			"Delete it with `helm delete --purge %s` before deploying again.", stuck, p.Config.Release)
+	}
+	if mode == "fail" {
+		return fmt.Errorf("Error: %s. Roll it back to its last deployed revision with `helm rollback %s %d`, "+
+			"or set pending_recovery: rollback.", stuck, p.Config.Release, deployed.Revision)
+	}
+
+	fmt.Printf("%s, rolling back to revision %d\n", stuck, deployed.Revision)
+	if p.Config.DryRun {
+		return nil
+	}
+	if err := runCommand(doHelmRollback(p, deployed.Revision)); err != nil {
+		return fmt.Errorf("Error rolling back %s: %v", p.Config.Release, err)
+	}
+	return nil
+}
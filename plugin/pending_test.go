@@ -0,0 +1,90 @@
+package plugin
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+const testPendingHelm = `case "$1" in
+list) echo '{"Releases":[{"Name":"app","Status":"PENDING_UPGRADE"},{"Name":"other","Status":"DEPLOYED"}]}' ;;
+history) echo '[{"revision":3,"status":"SUPERSEDED"},{"revision":4,"status":"DEPLOYED"},{"revision":5,"status":"PENDING_UPGRADE","updated":"Tue Jan  8 10:00:00 2019"}]' ;;
+esac
+exit 0`
+
+func TestRecoverPendingReleaseRollback(t *testing.T) {
+	calls, restore := fakeHelm(t, testPendingHelm)
+	defer restore()
+
+	plugin := &Plugin{Config: Config{Release: "app", PendingRecovery: "rollback"}}
+	if err := recoverPendingRelease(plugin); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadFile(calls)
+	if !strings.HasSuffix(string(data), "rollback app 4\n") {
+		t.Errorf("the release should have been rolled back to revision 4:\n%s", data)
+	}
+}
+
+func TestRecoverPendingReleaseFail(t *testing.T) {
+	calls, restore := fakeHelm(t, testPendingHelm)
+	defer restore()
+
+	plugin := &Plugin{Config: Config{Release: "app", PendingRecovery: "fail"}}
+	err := recoverPendingRelease(plugin)
+	if err == nil || !strings.Contains(err.Error(), "stuck in pending-upgrade at revision 5") || !strings.Contains(err.Error(), "helm rollback app 4") {
+		t.Fatalf("unexpected error %v", err)
+	}
+	data, _ := ioutil.ReadFile(calls)
+	if strings.Contains(string(data), "rollback") {
+		t.Errorf("the release should not have been rolled back:\n%s", data)
+	}
+}
+
+func TestRecoverPendingReleaseDeployed(t *testing.T) {
+	calls, restore := fakeHelm(t, testPendingHelm)
+	defer restore()
+
+	plugin := &Plugin{Config: Config{Release: "other", PendingRecovery: "rollback"}}
+	if err := recoverPendingRelease(plugin); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadFile(calls)
+	if string(data) != "list --all --output json\n" {
+		t.Errorf("a deployed release should be left alone:\n%s", data)
+	}
+}
+
+func TestRecoverPendingInstall(t *testing.T) {
+	_, restore := fakeHelm(t, `case "$1" in
+list) echo '[{"name":"app","status":"pending-install"}]' ;;
+history) echo '[{"revision":1,"status":"pending-install"}]' ;;
+esac
+exit 0`)
+	defer restore()
+
+	err := recoverPendingRelease(&Plugin{Config: Config{Release: "app", PendingRecovery: "rollback"}})
+	if err == nil || !strings.Contains(err.Error(), "helm delete --purge app") {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestRecoverPendingCanary(t *testing.T) {
+	calls, restore := fakeHelm(t, `case "$1" in
+list) echo '[{"name":"app","status":"deployed"},{"name":"app-canary","status":"pending-upgrade"}]' ;;
+history) echo '[{"revision":1,"status":"deployed"},{"revision":2,"status":"pending-upgrade"}]' ;;
+esac
+exit 0`)
+	defer restore()
+
+	plugin := &Plugin{Config: Config{HelmCommand: "upgrade", Release: "app", Chart: "./chart", Strategy: "canary", PendingRecovery: "fail"}}
+	setHelmCommand(plugin)
+	_, err := deployCanary(plugin)
+	if err == nil || !strings.Contains(err.Error(), "release app-canary is stuck") {
+		t.Fatalf("the stuck canary release should be detected, got %v", err)
+	}
+	data, _ := ioutil.ReadFile(calls)
+	if strings.Contains(string(data), "upgrade") {
+		t.Errorf("the canary should not have been upgraded:\n%s", data)
+	}
+}
@@ -14,48 +14,106 @@ import (
 
 var HELM_BIN = "/bin/helm"
 var KUBECONFIG = "/root/.kube/kubeconfig"
+var HELM_HOME = "/root/.helm"
 
 type (
 	// Config maps the params we need to run Helm
 	Config struct {
-		APIServer          string   `json:"api_server"`
-		Token              string   `json:"token"`
-		Certificate        string   `json:"certificate"`
-		ServiceAccount     string   `json:"service_account"`
-		KubeConfig         string   `json:"kube_config"`
-		HelmCommand        string   `json:"helm_command"`
-		SkipTLSVerify      bool     `json:"tls_skip_verify"`
-		Namespace          string   `json:"namespace"`
-		Release            string   `json:"release"`
-		Chart              string   `json:"chart"`
-		Version            string   `json:"version"`
-		EKSCluster         string   `json:"eks_cluster"`
-		EKSRoleARN         string   `json:"eks_role_arn"`
-		Values             string   `json:"values"`
-		StringValues       string   `json:"string_values"`
-		ValuesFiles        string   `json:"values_files"`
-		Debug              bool     `json:"debug"`
-		DryRun             bool     `json:"dry_run"`
-		Secrets            []string `json:"secrets"`
-		Prefix             string   `json:"prefix"`
-		TillerNs           string   `json:"tiller_ns"`
-		Wait               bool     `json:"wait"`
-		RecreatePods       bool     `json:"recreate_pods"`
-		Upgrade            bool     `json:"upgrade"`
-		CanaryImage        bool     `json:"canary_image"`
-		ClientOnly         bool     `json:"client_only"`
-		ReuseValues        bool     `json:"reuse_values"`
-		Timeout            string   `json:"timeout"`
-		Force              bool     `json:"force"`
-		HelmRepos          []string `json:"helm_repos"`
-		Purge              bool     `json:"purge"`
-		UpdateDependencies bool     `json:"update_dependencies"`
-		StableRepoURL      string   `json:"stable_repo_url"`
+		APIServer                 string   `json:"api_server"`
+		Token                     string   `json:"token"`
+		Certificate               string   `json:"certificate"`
+		ServiceAccount            string   `json:"service_account"`
+		KubeConfig                string   `json:"kube_config"`
+		HelmCommand               string   `json:"helm_command"`
+		SkipTLSVerify             bool     `json:"tls_skip_verify"`
+		Namespace                 string   `json:"namespace"`
+		Release                   string   `json:"release"`
+		Chart                     string   `json:"chart"`
+		Version                   string   `json:"version"`
+		EKSCluster                string   `json:"eks_cluster"`
+		EKSRoleARN                string   `json:"eks_role_arn"`
+		Values                    string   `json:"values"`
+		StringValues              string   `json:"string_values"`
+		ValuesFiles               string   `json:"values_files"`
+		Debug                     bool     `json:"debug"`
+		DryRun                    bool     `json:"dry_run"`
+		Secrets                   []string `json:"secrets"`
+		Prefix                    string   `json:"prefix"`
+		TillerNs                  string   `json:"tiller_ns"`
+		Wait                      bool     `json:"wait"`
+		RecreatePods              bool     `json:"recreate_pods"`
+		Upgrade                   bool     `json:"upgrade"`
+		CanaryImage               bool     `json:"canary_image"`
+		ClientOnly                bool     `json:"client_only"`
+		ReuseValues               bool     `json:"reuse_values"`
+		Timeout                   string   `json:"timeout"`
+		Force                     bool     `json:"force"`
+		HelmRepos                 []string `json:"helm_repos"`
+		Purge                     bool     `json:"purge"`
+		UpdateDependencies        bool     `json:"update_dependencies"`
+		StableRepoURL             string   `json:"stable_repo_url"`
+		TLS                       bool     `json:"tls"`
+		TLSVerify                 bool     `json:"tls_verify"`
+		TLSCACert                 string   `json:"tls_ca_cert"`
+		TLSCert                   string   `json:"tls_cert"`
+		TLSKey                    string   `json:"tls_key"`
+		TillerTLSCert             string   `json:"tiller_tls_cert"`
+		TillerTLSKey              string   `json:"tiller_tls_key"`
+		TillerServiceAccount      string   `json:"tiller_service_account"`
+		TillerNamespaces          []string `json:"tiller_namespaces"`
+		TillerClusterAdmin        bool     `json:"tiller_cluster_admin"`
+		HistoryMax                string   `json:"history_max"`
+		RepoInsecureSkipTLSVerify []string `json:"repo_insecure_skip_tls_verify"`
+		ChartCache                string   `json:"chart_cache"`
+		RegistryPlainHTTP         bool     `json:"registry_plain_http"`
+		PackageDir                string   `json:"package_dir"`
+		AppVersion                string   `json:"app_version"`
+		SignKey                   string   `json:"sign_key"`
+		PushRepo                  string   `json:"push_repo"`
+		AutoVersion               bool     `json:"auto_version"`
+		Verify                    bool     `json:"verify"`
+		ChartDigest               string   `json:"chart_digest"`
+		SanitizeNames             bool     `json:"sanitize_names"`
+		Preview                   bool     `json:"preview"`
+		PreviewTTL                string   `json:"preview_ttl"`
+		PreviewURLFile            string   `json:"preview_url_file"`
+		CleanupTTL                string   `json:"cleanup_ttl"`
+		CleanupPattern            string   `json:"cleanup_pattern"`
+		CleanupSelector           string   `json:"cleanup_selector"`
+		CleanupProtected          []string `json:"cleanup_protected"`
+		CreateNamespace           bool     `json:"create_namespace"`
+		NamespaceLabels           string   `json:"namespace_labels"`
+		NamespaceAnnotations      string   `json:"namespace_annotations"`
+		OutputFile                string   `json:"output_file"`
+		VerifyRollout             bool     `json:"verify_rollout"`
+		RolloutTimeout            string   `json:"rollout_timeout"`
+		Diagnostics               bool     `json:"diagnostics"`
+		DiagnosticsFile           string   `json:"diagnostics_file"`
+		DiagnosticsLogLines       int      `json:"diagnostics_log_lines"`
+		SmokeTests                string   `json:"smoke_tests"`
+		SmokeRollback             bool     `json:"smoke_rollback"`
+		Strategy                  string   `json:"strategy"`
+		CanaryValues              string   `json:"canary_values"`
+		CanaryBake                string   `json:"canary_bake"`
+		BlueGreenKey              string   `json:"bluegreen_key"`
+		BlueGreenRouter           string   `json:"bluegreen_router"`
+		BlueGreenRouterChart      string   `json:"bluegreen_router_chart"`
+		BlueGreenRemoveOld        bool     `json:"bluegreen_remove_old"`
+		Lock                      bool     `json:"lock"`
+		LockTimeout               string   `json:"lock_timeout"`
+		LockTTL                   string   `json:"lock_ttl"`
+		PendingRecovery           string   `json:"pending_recovery"`
+		Policy                    string   `json:"policy"`
+		ValidateValues            bool     `json:"validate_values"`
+		ValuesSchema              string   `json:"values_schema"`
+		ValuesFile                string   `json:"values_file"`
+		VaultAddr                 string   `json:"vault_addr"`
 	}
 	// Plugin default
 	Plugin struct {
 		Config  Config
 		command []string
+		secrets []string
 	}
 )
 
@@ -71,6 +129,7 @@ func setDeleteCommand(p *Plugin) {
 		delete = append(delete, "--tiller-namespace")
 		delete = append(delete, p.Config.TillerNs)
 	}
+	delete = append(delete, tlsFlags(p)...)
 	if p.Config.DryRun {
 		delete = append(delete, "--dry-run")
 	}
@@ -81,6 +140,26 @@ func setDeleteCommand(p *Plugin) {
 	p.command = delete
 }
 
+// valuesFlags returns the flags passing the configured values to helm
+func valuesFlags(p *Plugin) []string {
+	flags := []string{}
+	if p.Config.Values != "" {
+		flags = append(flags, "--set")
+		flags = append(flags, unQuote(p.Config.Values))
+	}
+	if p.Config.StringValues != "" {
+		flags = append(flags, "--set-string")
+		flags = append(flags, unQuote(p.Config.StringValues))
+	}
+	if p.Config.ValuesFiles != "" {
+		for _, valuesFile := range strings.Split(p.Config.ValuesFiles, ",") {
+			flags = append(flags, "--values")
+			flags = append(flags, valuesFile)
+		}
+	}
+	return flags
+}
+
 func setUpgradeCommand(p *Plugin) {
 	upgrade := make([]string, 2)
 	upgrade[0] = "upgrade"
@@ -94,20 +173,7 @@ func setUpgradeCommand(p *Plugin) {
 		upgrade = append(upgrade, "--version")
 		upgrade = append(upgrade, p.Config.Version)
 	}
-	if p.Config.Values != "" {
-		upgrade = append(upgrade, "--set")
-		upgrade = append(upgrade, unQuote(p.Config.Values))
-	}
-	if p.Config.StringValues != "" {
-		upgrade = append(upgrade, "--set-string")
-		upgrade = append(upgrade, unQuote(p.Config.StringValues))
-	}
-	if p.Config.ValuesFiles != "" {
-		for _, valuesFile := range strings.Split(p.Config.ValuesFiles, ",") {
-			upgrade = append(upgrade, "--values")
-			upgrade = append(upgrade, valuesFile)
-		}
-	}
+	upgrade = append(upgrade, valuesFlags(p)...)
 	if p.Config.Namespace != "" {
 		upgrade = append(upgrade, "--namespace")
 		upgrade = append(upgrade, p.Config.Namespace)
@@ -116,6 +182,7 @@ func setUpgradeCommand(p *Plugin) {
 		upgrade = append(upgrade, "--tiller-namespace")
 		upgrade = append(upgrade, p.Config.TillerNs)
 	}
+	upgrade = append(upgrade, tlsFlags(p)...)
 	if p.Config.DryRun {
 		upgrade = append(upgrade, "--dry-run")
 	}
@@ -189,6 +256,8 @@ func setHelmCommand(p *Plugin) {
 		setDeleteCommand(p)
 	case "lint":
 		setLintCommand(p)
+	case "package", "push":
+		setPackageCommand(p)
 	default:
 		switch os.Getenv("DRONE_BUILD_EVENT") {
 		case "push", "tag", "deployment", "pull_request", "promote", "rollback":
@@ -202,7 +271,7 @@ func setHelmCommand(p *Plugin) {
 
 }
 
-var repoExp = regexp.MustCompile(`^(?P<name>[\w-]+)=(?P<url>(http|https)://[\w-./:@-]+)`)
+var repoExp = regexp.MustCompile(`^(?P<name>[\w-]+)=(?P<url>(http|https|oci)://[\w-./:@-]+)`)
 
 // parseRepo returns map of regex capture groups (name, url)
 func parseRepo(repo string) (map[string]string, error) {
@@ -219,18 +288,67 @@ func parseRepo(repo string) (map[string]string, error) {
 	return result, nil
 }
 
-func doHelmRepoAdd(repo string) ([]string, error) {
-	repoMap, err := parseRepo(unQuote(repo))
+func doHelmRepoAdd(p *Plugin, repo string) ([]string, error) {
+	r, err := resolveRepo(p, repo)
 	if err != nil {
 		return nil, err
 	}
+	// registries are not helm repositories, charts are pulled from them
+	// directly by pullOCIChart
+	if isOCI(r.URL) {
+		return nil, nil
+	}
 	repoAdd := []string{
 		"repo",
 		"add",
-		repoMap["name"],
-		repoMap["url"],
+		r.Name,
+		r.URL,
+	}
+	if r.Username != "" {
+		repoAdd = append(repoAdd, "--username")
+		repoAdd = append(repoAdd, r.Username)
+	}
+	if r.Password != "" {
+		repoAdd = append(repoAdd, "--password")
+		repoAdd = append(repoAdd, r.Password)
+	}
+	if r.CACert != "" {
+		repoAdd = append(repoAdd, "--ca-file")
+		repoAdd = append(repoAdd, r.caFile())
+	}
+	if r.Cert != "" {
+		repoAdd = append(repoAdd, "--cert-file")
+		repoAdd = append(repoAdd, r.certFile())
+	}
+	if r.Key != "" {
+		repoAdd = append(repoAdd, "--key-file")
+		repoAdd = append(repoAdd, r.keyFile())
 	}
-	return repoAdd, nil
+	if r.InsecureSkipTLSVerify {
+		repoAdd = append(repoAdd, "--insecure-skip-tls-verify")
+	}
+	return repoAdd, r.writeFiles()
+}
+
+// addHelmRepos adds the configured helm_repos to helm
+func addHelmRepos(p *Plugin) error {
+	for _, repo := range p.Config.HelmRepos {
+		repoAdd, err := doHelmRepoAdd(p, repo)
+		if err != nil {
+			return err
+		}
+		if repoAdd == nil {
+			continue
+		}
+		if p.Config.Debug {
+			log.Println("adding helm repo: " + strings.Join(maskArgs(repoAdd), " "))
+		}
+
+		if err = runCommand(repoAdd); err != nil {
+			return fmt.Errorf("Error adding helm repo: %v", err)
+		}
+	}
+	return nil
 }
 
 func doHelmInit(p *Plugin) []string {
@@ -253,6 +371,18 @@ func doHelmInit(p *Plugin) []string {
 	if p.Config.CanaryImage {
 		init = append(init, "--canary-image")
 	}
+	if !p.Config.ClientOnly {
+		init = append(init, initTLSFlags(p)...)
+		if p.Config.TillerServiceAccount != "" {
+			init = append(init, "--service-account")
+			init = append(init, p.Config.TillerServiceAccount)
+			init = append(init, "--wait")
+		}
+		if p.Config.HistoryMax != "" {
+			init = append(init, "--history-max")
+			init = append(init, p.Config.HistoryMax)
+		}
+	}
 
 	return init
 
@@ -274,9 +404,34 @@ func (p *Plugin) Exec() error {
 		p.debugEnv()
 	}
 
+	switch p.Config.HelmCommand {
+	case "package", "push":
+		return p.publish()
+	}
+
+	if p.Config.SanitizeNames {
+		if err := sanitizeNames(p); err != nil {
+			return err
+		}
+	}
+
+	if isPreview(p) {
+		if err := namePreview(p); err != nil {
+			return err
+		}
+	}
+
+	if p.Config.Policy != "" {
+		if err := checkPolicy(p); err != nil {
+			return err
+		}
+	}
+
 	// create /root/.kube/config file if not exists
 	if _, err := os.Stat(p.Config.KubeConfig); os.IsNotExist(err) {
-		resolveSecrets(p)
+		if err := resolveSecrets(p); err != nil {
+			return err
+		}
 		if p.Config.APIServer == "" {
 			return fmt.Errorf("Error: API Server is needed to deploy.")
 		}
@@ -286,50 +441,172 @@ func (p *Plugin) Exec() error {
 			}
 		}
 		initialiseKubeconfig(&p.Config, KUBECONFIG, p.Config.KubeConfig)
+	} else if err := resolveVaultSecrets(p); err != nil {
+		return err
 	}
 
 	if p.Config.Debug {
 		p.debug()
 	}
 
+	if err := writeTLSFiles(p); err != nil {
+		return fmt.Errorf("Error writing TLS certificates: %v", err)
+	}
+
+	if p.Config.TillerServiceAccount != "" && !p.Config.ClientOnly {
+		if err := bootstrapTiller(p); err != nil {
+			return err
+		}
+	}
+
 	init := doHelmInit(p)
 	err := runCommand(init)
 	if err != nil {
-		return fmt.Errorf("Error running helm command: " + strings.Join(init[:], " "))
-	}
-
-	if len(p.Config.HelmRepos) > 0 {
-		for _, repo := range p.Config.HelmRepos {
-			repoAdd, err := doHelmRepoAdd(repo)
-			if err == nil {
-				if p.Config.Debug {
-					log.Println("adding helm repo: " + strings.Join(repoAdd[:], " "))
-				}
-
-				if err = runCommand(repoAdd); err != nil {
-					return fmt.Errorf("Error adding helm repo: " + err.Error())
-				}
-			} else {
-				return err
-			}
+		return fmt.Errorf("Error running helm command: %s", strings.Join(init, " "))
+	}
+
+	switch p.Config.HelmCommand {
+	case "cleanup":
+		return cleanupReleases(p)
+	case "status", "history":
+		return inspectRelease(p)
+	}
+
+	if err = addHelmRepos(p); err != nil {
+		return err
+	}
+
+	if err = pullOCIChart(p); err != nil {
+		return err
+	}
+
+	cleanup, err := verifyChart(p)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	if p.Config.AutoVersion {
+		cleanup, err := versionChart(p)
+		if err != nil {
+			return err
 		}
+		defer cleanup()
 	}
 
 	if p.Config.UpdateDependencies {
 		if err = runCommand(doDependencyUpdate(p.Config.Chart)); err != nil {
-			return fmt.Errorf("Error updating dependencies: " + err.Error())
+			return fmt.Errorf("Error updating dependencies: %v", err)
 		}
 	}
 
+	removeDecrypted, err := decryptValuesFiles(p)
+	if err != nil {
+		return err
+	}
+	defer removeDecrypted()
+
+	if p.Config.HelmCommand == "values" {
+		return previewValues(p)
+	}
+
 	setHelmCommand(p)
 
+	if (p.Config.ValidateValues || p.Config.ValuesSchema != "") && (p.command[0] == "upgrade" || p.command[0] == "lint") {
+		if err = validateValues(p); err != nil {
+			return err
+		}
+	}
+
+	if p.Config.Policy != "" && p.command[0] == "upgrade" {
+		if err = checkManifests(p); err != nil {
+			return err
+		}
+	}
+
+	var lock *releaseLock
+	if p.Config.Lock && !p.Config.DryRun && (p.command[0] == "upgrade" || p.command[0] == "delete") {
+		if lock, err = lockRelease(p); err != nil {
+			return err
+		}
+		defer lock.unlock()
+	}
+
+	if isPreview(p) {
+		if err = preparePreview(p); err != nil {
+			return err
+		}
+	}
+
+	if p.Config.CreateNamespace && p.command[0] == "upgrade" {
+		if err = createNamespace(p); err != nil {
+			return err
+		}
+	}
+
 	if p.Config.Debug {
-		log.Println("helm command: " + strings.Join(p.command, " "))
+		log.Println("helm command: " + redact(p, strings.Join(p.command, " ")))
+	}
+
+	var switchover *blueGreen
+	if isBlueGreen(p) {
+		if switchover, err = prepareBlueGreen(p); err != nil {
+			return err
+		}
 	}
 
+	// after prepareBlueGreen, so the colour release is the one recovered
+	if p.Config.PendingRecovery != "" && p.command[0] == "upgrade" && p.Config.Release != "" {
+		if err = recoverPendingRelease(p); err != nil {
+			return err
+		}
+	}
+
+	if isCanary(p) {
+		removeCanary, err := deployCanary(p)
+		if err != nil {
+			return err
+		}
+		defer removeCanary()
+	}
+
+	if err = lock.held(); err != nil {
+		return err
+	}
 	err = runCommand(p.command)
 	if err != nil {
-		return fmt.Errorf("Error running helm command: " + strings.Join(p.command[:], " "))
+		if p.Config.Diagnostics && p.command[0] == "upgrade" && !p.Config.DryRun {
+			collectDiagnostics(p)
+		}
+		return fmt.Errorf("Error running helm command: %s", redact(p, strings.Join(p.command, " ")))
+	}
+	if err = lock.held(); err != nil {
+		return err
+	}
+
+	if p.Config.VerifyRollout && p.command[0] == "upgrade" && !p.Config.DryRun {
+		if err = verifyRollout(p); err != nil {
+			if p.Config.Diagnostics {
+				collectDiagnostics(p)
+			}
+			return err
+		}
+	}
+
+	if switchover != nil && !p.Config.DryRun {
+		if err = switchover.promote(p); err != nil {
+			return err
+		}
+	} else if p.Config.SmokeTests != "" && p.command[0] == "upgrade" && !p.Config.DryRun {
+		if err = runSmokeTests(p); err != nil {
+			return err
+		}
+	}
+
+	if isPreview(p) && p.command[0] == "upgrade" && !p.Config.DryRun {
+		if err = publishPreviewURL(p); err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -358,10 +635,23 @@ func runCommand(params []string) error {
 	return err
 }
 
-func resolveSecrets(p *Plugin) {
+// runCommandOutput runs helm and returns what it prints on stdout
+func runCommandOutput(params []string) ([]byte, error) {
+	cmd := exec.Command(HELM_BIN, params...)
+	cmd.Stderr = os.Stderr
+	return cmd.Output()
+}
+
+func resolveSecrets(p *Plugin) error {
 	p.Config.Values = resolveEnvVar(p.Config.Values, p.Config.Prefix, p.Config.Debug)
 	p.Config.StringValues = resolveEnvVar(p.Config.StringValues, p.Config.Prefix, p.Config.Debug)
+	resolveKubeSecrets(p)
+	return resolveVaultSecrets(p)
+}
 
+// resolveKubeSecrets fills the Kubernetes credentials from the prefixed
+// secrets when they have not been given explicitly
+func resolveKubeSecrets(p *Plugin) {
 	if p.Config.APIServer == "" {
 		p.Config.APIServer = resolveEnvVar("${API_SERVER}", p.Config.Prefix, p.Config.Debug)
 	}
@@ -431,11 +721,10 @@ func (p *Plugin) debugEnv() {
 }
 
 func (p *Plugin) debug() {
-	fmt.Println(p)
 	// debug plugin obj
 	fmt.Printf("Api server: %s \n", p.Config.APIServer)
-	fmt.Printf("Values: %s \n", p.Config.Values)
-	fmt.Printf("StringValues: %s \n", p.Config.StringValues)
+	fmt.Printf("Values: %s \n", redact(p, p.Config.Values))
+	fmt.Printf("StringValues: %s \n", redact(p, p.Config.StringValues))
 	fmt.Printf("Secrets: %s \n", p.Config.Secrets)
 	fmt.Printf("Helm Repos: %s \n", p.Config.HelmRepos)
 	fmt.Printf("ValuesFiles: %s \n", p.Config.ValuesFiles)
@@ -355,7 +355,7 @@ func TestDetHelmRepoAdd(t *testing.T) {
 	}
 
 	for i, r := range plugin.Config.HelmRepos {
-		repos, err := doHelmRepoAdd(r)
+		repos, err := doHelmRepoAdd(plugin, r)
 		if err != nil {
 			t.Error(err)
 		}
@@ -380,7 +380,7 @@ func TestDependencyUpdate(t *testing.T) {
 }
 
 func TestHelmAddRepositoryError(t *testing.T) {
-	_, err := doHelmRepoAdd("drone-helm=bad://drone-helm.example.com:443/stable")
+	_, err := doHelmRepoAdd(&Plugin{}, "drone-helm=bad://drone-helm.example.com:443/stable")
 	if err == nil {
 		t.Errorf("Expect to see error when repo URL is invalid")
 	}
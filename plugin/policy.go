@@ -0,0 +1,130 @@
+package plugin
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// policy holds the guardrails checked before deploying
+type policy struct {
+	ForbiddenNamespaces []string        `yaml:"forbidden_namespaces"`
+	ReleasePatterns     []releasePolicy `yaml:"release_patterns"`
+	ProtectedReleases   []string        `yaml:"protected_releases"`
+	PinnedPrefixes      []string        `yaml:"pinned_prefixes"`
+	// rules checked against the rendered manifests
+	DenyPrivileged    bool     `yaml:"deny_privileged"`
+	DenyLatestTag     bool     `yaml:"deny_latest_tag"`
+	RequireLimits     bool     `yaml:"require_limits"`
+	DenyHostPath      bool     `yaml:"deny_host_path"`
+	AllowedRegistries []string `yaml:"allowed_registries"`
+}
+
+// releasePolicy restricts the release names builds of matching branches
+// and events can deploy
+type releasePolicy struct {
+	Branch  string `yaml:"branch"`
+	Event   string `yaml:"event"`
+	Pattern string `yaml:"pattern"`
+}
+
+// loadPolicy reads the policy setting, given inline as YAML or JSON, or as
+// the path of a file holding it
+func loadPolicy(s string) (*policy, error) {
+	data := []byte(s)
+	if info, err := os.Stat(s); err == nil && !info.IsDir() {
+		if data, err = ioutil.ReadFile(s); err != nil {
+			return nil, fmt.Errorf("Error reading policy %s: %v", s, err)
+		}
+	}
+	pol := &policy{}
+	if err := yaml.UnmarshalStrict(data, pol); err != nil {
+		return nil, fmt.Errorf("Error parsing policy: %v", err)
+	}
+	return pol, nil
+}
+
+// globMatch tells if name matches one of the glob patterns
+func globMatch(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// violations lists every rule of the policy the deploy breaks
+func (pol *policy) violations(p *Plugin) ([]string, error) {
+	violations := []string{}
+	release := p.Config.Release
+
+	namespace := p.Config.Namespace
+	if namespace == "" {
+		namespace = "default"
+	}
+	if globMatch(pol.ForbiddenNamespaces, namespace) {
+		violations = append(violations, fmt.Sprintf("namespace %s is forbidden", namespace))
+	}
+
+	branch := os.Getenv("DRONE_BRANCH")
+	event := os.Getenv("DRONE_BUILD_EVENT")
+	allowed := []string{}
+	for _, rule := range pol.ReleasePatterns {
+		if rule.Branch != "" && !globMatch([]string{rule.Branch}, branch) {
+			continue
+		}
+		if rule.Event != "" && !globMatch([]string{rule.Event}, event) {
+			continue
+		}
+		pattern, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("Error: invalid release pattern %s in policy: %v", rule.Pattern, err)
+		}
+		if pattern.MatchString(release) {
+			allowed = nil
+			break
+		}
+		allowed = append(allowed, rule.Pattern)
+	}
+	if len(allowed) > 0 {
+		violations = append(violations, fmt.Sprintf("release %s doesn't match %s, allowed for %s builds of %s",
+			release, strings.Join(allowed, " or "), event, branch))
+	}
+
+	if globMatch(pol.ProtectedReleases, release) {
+		if p.Config.Force {
+			violations = append(violations, fmt.Sprintf("force is not allowed on protected release %s", release))
+		}
+		if p.Config.Purge {
+			violations = append(violations, fmt.Sprintf("purge is not allowed on protected release %s", release))
+		}
+	}
+
+	if p.Config.Prefix != "" && globMatch(pol.PinnedPrefixes, p.Config.Prefix) && p.Config.Version == "" {
+		violations = append(violations, fmt.Sprintf("chart_version has to be pinned to deploy with prefix %s", p.Config.Prefix))
+	}
+	return violations, nil
+}
+
+// checkPolicy fails the build when the deploy breaks the policy, listing
+// every rule broken
+func checkPolicy(p *Plugin) error {
+	pol, err := loadPolicy(p.Config.Policy)
+	if err != nil {
+		return err
+	}
+	violations, err := pol.violations(p)
+	if err != nil {
+		return err
+	}
+	if len(violations) == 0 {
+		return nil
+	}
+	return fmt.Errorf("Error: the deploy breaks the policy:\n - %s", strings.Join(violations, "\n - "))
+}
@@ -0,0 +1,105 @@
+package plugin
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testPolicy = `
+forbidden_namespaces: [kube-system, kube-*]
+release_patterns:
+  - branch: master
+    pattern: ^app-(staging|production)$
+  - event: pull_request
+    pattern: -pr-[0-9]+$
+protected_releases: [app-production]
+pinned_prefixes: [PROD*]
+`
+
+func TestCheckPolicy(t *testing.T) {
+	restore := setDroneEnv(map[string]string{"DRONE_BRANCH": "master", "DRONE_BUILD_EVENT": "push"})
+	defer restore()
+
+	plugin := &Plugin{
+		Config: Config{
+			Policy:    testPolicy,
+			Release:   "app-production",
+			Namespace: "production",
+			Prefix:    "PRODUCTION",
+			Version:   "1.2.3",
+		},
+	}
+	if err := checkPolicy(plugin); err != nil {
+		t.Errorf("the deploy follows the policy: %v", err)
+	}
+
+	plugin.Config.Release = "app-production"
+	plugin.Config.Namespace = "kube-system"
+	plugin.Config.Force = true
+	plugin.Config.Version = ""
+	err := checkPolicy(plugin)
+	if err == nil {
+		t.Fatal("the deploy breaks the policy")
+	}
+	for _, expected := range []string{
+		"namespace kube-system is forbidden",
+		"force is not allowed on protected release app-production",
+		"chart_version has to be pinned to deploy with prefix PRODUCTION",
+	} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("%q should be reported in %v", expected, err)
+		}
+	}
+}
+
+func TestCheckPolicyReleasePatterns(t *testing.T) {
+	restore := setDroneEnv(map[string]string{"DRONE_BRANCH": "master", "DRONE_BUILD_EVENT": "push"})
+	defer restore()
+
+	err := checkPolicy(&Plugin{Config: Config{Policy: testPolicy, Release: "feature-x", Namespace: "web"}})
+	if err == nil || !strings.Contains(err.Error(), "release feature-x doesn't match ^app-(staging|production)$") {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	os.Setenv("DRONE_BRANCH", "feature/x")
+	if err := checkPolicy(&Plugin{Config: Config{Policy: testPolicy, Release: "feature-x", Namespace: "web"}}); err != nil {
+		t.Errorf("no release pattern applies to feature branches: %v", err)
+	}
+}
+
+func TestCheckPolicyPreview(t *testing.T) {
+	restore := setDroneEnv(map[string]string{"DRONE_BRANCH": "feature/x", "DRONE_BUILD_EVENT": "pull_request", "DRONE_PULL_REQUEST": "42"})
+	defer restore()
+
+	plugin := &Plugin{Config: Config{Policy: testPolicy, Release: "app", Namespace: "kube-system", Preview: true}}
+	if err := namePreview(plugin); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkPolicy(plugin); err != nil {
+		t.Errorf("the policy should be checked against the preview names: %v", err)
+	}
+}
+
+func TestLoadPolicyFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "policy.yaml")
+	ioutil.WriteFile(file, []byte(testPolicy), 0644)
+	pol, err := loadPolicy(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pol.ReleasePatterns) != 2 || pol.ProtectedReleases[0] != "app-production" {
+		t.Errorf("unexpected policy %+v", pol)
+	}
+	if _, err := loadPolicy(`{"forbiden_namespaces": ["kube-system"]}`); err == nil {
+		t.Error("misspelled rules should be refused")
+	}
+}
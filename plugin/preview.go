@@ -0,0 +1,198 @@
+package plugin
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	previewLabel          = "drone-helm/preview"
+	previewPRLabel        = "drone-helm/pull-request"
+	previewRepoLabel      = "drone-helm/repo"
+	previewCommitLabel    = "drone-helm/commit"
+	previewExpiresLabel   = "drone-helm/expires"
+	previewURLAnnotation  = "drone-helm/preview-url"
+	previewRepoAnnotation = "drone-helm/repo"
+	defaultPreviewTTL     = "168h"
+)
+
+// ingress groups, from the most recent one
+var ingressAPIs = []string{
+	"/apis/networking.k8s.io/v1",
+	"/apis/networking.k8s.io/v1beta1",
+	"/apis/extensions/v1beta1",
+}
+
+// isPreview tells if the build deploys a pull request preview environment.
+// Only upgrades do, which is what pull_request builds run by default.
+func isPreview(p *Plugin) bool {
+	if p.Config.HelmCommand != "" && p.Config.HelmCommand != "upgrade" {
+		return false
+	}
+	return p.Config.Preview && os.Getenv("DRONE_BUILD_EVENT") == "pull_request"
+}
+
+// namePreview points the release and namespace at the pull request
+// environment, e.g. my-app-pr-42
+func namePreview(p *Plugin) error {
+	pr := os.Getenv("DRONE_PULL_REQUEST")
+	if pr == "" {
+		return fmt.Errorf("Error: DRONE_PULL_REQUEST is needed to deploy a preview environment.")
+	}
+	base := p.Config.Release
+	if base == "" {
+		base = os.Getenv("DRONE_REPO_NAME")
+	}
+	name, err := sanitizeName(base+"-pr-"+pr, maxReleaseLength)
+	if err != nil {
+		return err
+	}
+	p.Config.Release = name
+	p.Config.Namespace = name
+	return nil
+}
+
+// preparePreview creates the namespace named by namePreview, labelled with
+// the pull request details and when it expires
+func preparePreview(p *Plugin) error {
+	pr := os.Getenv("DRONE_PULL_REQUEST")
+	name := p.Config.Namespace
+
+	ttl := p.Config.PreviewTTL
+	if ttl == "" {
+		ttl = defaultPreviewTTL
+	}
+	duration, err := time.ParseDuration(ttl)
+	if err != nil {
+		return fmt.Errorf("Error: invalid preview_ttl %s: %v", ttl, err)
+	}
+
+	labels := map[string]string{
+		previewLabel:        "true",
+		previewPRLabel:      labelValue(pr),
+		previewRepoLabel:    labelValue(os.Getenv("DRONE_REPO")),
+		previewCommitLabel:  labelValue(os.Getenv("DRONE_COMMIT_SHA")),
+		previewExpiresLabel: strconv.FormatInt(time.Now().Add(duration).Unix(), 10),
+	}
+	annotations := map[string]string{
+		previewRepoAnnotation: os.Getenv("DRONE_REPO"),
+	}
+
+	if p.Config.Debug {
+		log.Printf("deploying preview environment %s for pull request %s\n", name, pr)
+	}
+	if p.Config.DryRun {
+		return nil
+	}
+	kube, err := newKubeClient(p)
+	if err != nil {
+		return err
+	}
+	if err := ensureNamespace(kube, name, labels, annotations); err != nil {
+		return fmt.Errorf("Error creating preview namespace %s: %v", name, err)
+	}
+	return nil
+}
+
+// publishPreviewURL looks up the ingress of the preview environment and
+// records its url on the namespace and in preview_url_file
+func publishPreviewURL(p *Plugin) error {
+	kube, err := newKubeClient(p)
+	if err != nil {
+		return err
+	}
+	urls, err := ingressURLs(kube, p.Config.Namespace)
+	if err != nil {
+		return fmt.Errorf("Error looking up the preview url: %v", err)
+	}
+	if len(urls) == 0 {
+		log.Println("no ingress found for preview environment " + p.Config.Namespace)
+		return nil
+	}
+
+	url := urls[0]
+	fmt.Println("preview environment available at " + url)
+	if err := ensureNamespace(kube, p.Config.Namespace, nil, map[string]string{previewURLAnnotation: url}); err != nil {
+		return fmt.Errorf("Error annotating preview namespace: %v", err)
+	}
+	if p.Config.PreviewURLFile != "" {
+		return ioutil.WriteFile(p.Config.PreviewURLFile, []byte(url+"\n"), 0644)
+	}
+	return nil
+}
+
+type ingressList struct {
+	Items []struct {
+		Spec struct {
+			TLS []struct {
+				Hosts []string `json:"hosts"`
+			} `json:"tls"`
+			Rules []struct {
+				Host string `json:"host"`
+				HTTP *struct {
+					Paths []struct {
+						Path string `json:"path"`
+					} `json:"paths"`
+				} `json:"http"`
+			} `json:"rules"`
+		} `json:"spec"`
+	} `json:"items"`
+}
+
+// ingressURLs returns the urls served by the ingresses of a namespace
+func ingressURLs(kube *kubeClient, namespace string) ([]string, error) {
+	for _, group := range ingressAPIs {
+		ingresses := ingressList{}
+		err := kube.get(namespacedPath(group, namespace, "ingresses"), &ingresses)
+		if isNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		urls := []string{}
+		for _, ingress := range ingresses.Items {
+			secure := map[string]bool{}
+			for _, tls := range ingress.Spec.TLS {
+				for _, host := range tls.Hosts {
+					secure[host] = true
+				}
+			}
+			for _, rule := range ingress.Spec.Rules {
+				if rule.Host == "" {
+					continue
+				}
+				scheme := "http://"
+				if secure[rule.Host] {
+					scheme = "https://"
+				}
+				path := "/"
+				if rule.HTTP != nil && len(rule.HTTP.Paths) > 0 && rule.HTTP.Paths[0].Path != "" {
+					path = rule.HTTP.Paths[0].Path
+				}
+				urls = append(urls, scheme+rule.Host+path)
+			}
+		}
+		return urls, nil
+	}
+	return nil, nil
+}
+
+var invalidLabelChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// labelValue turns s into a valid label value, e.g. owner/repo gives
+// owner-repo
+func labelValue(s string) string {
+	value := invalidLabelChars.ReplaceAllString(s, "-")
+	if len(value) > 63 {
+		value = value[:63]
+	}
+	return strings.Trim(value, "-_.")
+}
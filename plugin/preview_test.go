@@ -0,0 +1,125 @@
+package plugin
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestPreparePreview(t *testing.T) {
+	api, server := newFakeKubeAPI()
+	defer server.Close()
+
+	restore := setDroneEnv(map[string]string{
+		"DRONE_BUILD_EVENT":  "pull_request",
+		"DRONE_PULL_REQUEST": "42",
+		"DRONE_REPO":         "octocat/Hello_World",
+		"DRONE_REPO_NAME":    "Hello_World",
+		"DRONE_COMMIT_SHA":   "0123456789abcdef",
+	})
+	defer restore()
+
+	plugin := &Plugin{
+		Config: Config{
+			APIServer:  server.URL,
+			Token:      "secret-token",
+			Preview:    true,
+			PreviewTTL: "24h",
+		},
+	}
+	if !isPreview(plugin) {
+		t.Fatal("pull requests should deploy a preview environment")
+	}
+	if err := namePreview(plugin); err != nil {
+		t.Fatal(err)
+	}
+	if plugin.Config.Release != "hello-world-pr-42" || plugin.Config.Namespace != "hello-world-pr-42" {
+		t.Errorf("unexpected release %s and namespace %s", plugin.Config.Release, plugin.Config.Namespace)
+	}
+	if len(api.requests) > 0 {
+		t.Errorf("naming the preview should not talk to the cluster: %v", api.requests)
+	}
+	if err := preparePreview(plugin); err != nil {
+		t.Fatal(err)
+	}
+
+	namespace, ok := api.objects["/api/v1/namespaces/hello-world-pr-42"]
+	if !ok {
+		t.Fatal("preview namespace has not been created")
+	}
+	labels := namespace["metadata"].(map[string]interface{})["labels"].(map[string]interface{})
+	if labels[previewPRLabel] != "42" || labels[previewRepoLabel] != "octocat-Hello_World" || labels[previewCommitLabel] != "0123456789abcdef" {
+		t.Errorf("unexpected labels %v", labels)
+	}
+	expires, _ := strconv.ParseInt(labels[previewExpiresLabel].(string), 10, 64)
+	if delta := time.Unix(expires, 0).Sub(time.Now()); delta < 23*time.Hour || delta > 25*time.Hour {
+		t.Errorf("preview expires in %v, expected 24h", delta)
+	}
+}
+
+func TestPreviewOnlyForPullRequests(t *testing.T) {
+	restore := setDroneEnv(map[string]string{"DRONE_BUILD_EVENT": "push"})
+	defer restore()
+
+	if isPreview(&Plugin{Config: Config{Preview: true}}) {
+		t.Error("push events should not deploy a preview environment")
+	}
+
+	os.Setenv("DRONE_BUILD_EVENT", "pull_request")
+	for _, command := range []string{"delete", "lint", "cleanup", "status", "history", "values"} {
+		if isPreview(&Plugin{Config: Config{Preview: true, HelmCommand: command}}) {
+			t.Errorf("helm_command %s should not deploy a preview environment", command)
+		}
+	}
+	if !isPreview(&Plugin{Config: Config{Preview: true, HelmCommand: "upgrade"}}) {
+		t.Error("upgrades of pull requests should deploy a preview environment")
+	}
+}
+
+func TestPublishPreviewURL(t *testing.T) {
+	api, server := newFakeKubeAPI()
+	defer server.Close()
+
+	api.objects["/api/v1/namespaces/app-pr-7"] = map[string]interface{}{
+		"metadata": map[string]interface{}{"name": "app-pr-7", "labels": map[string]interface{}{previewLabel: "true"}},
+	}
+	api.objects["/apis/networking.k8s.io/v1/namespaces/app-pr-7/ingresses/app"] = map[string]interface{}{
+		"metadata": map[string]interface{}{"name": "app"},
+		"spec": map[string]interface{}{
+			"tls":   []interface{}{map[string]interface{}{"hosts": []string{"app-pr-7.preview.example.com"}}},
+			"rules": []interface{}{map[string]interface{}{"host": "app-pr-7.preview.example.com"}},
+		},
+	}
+
+	dir, err := ioutil.TempDir("", "preview")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	plugin := &Plugin{
+		Config: Config{
+			APIServer:      server.URL,
+			Namespace:      "app-pr-7",
+			PreviewURLFile: filepath.Join(dir, "url"),
+		},
+	}
+	if err := publishPreviewURL(plugin); err != nil {
+		t.Fatal(err)
+	}
+
+	data, _ := ioutil.ReadFile(plugin.Config.PreviewURLFile)
+	if string(data) != "https://app-pr-7.preview.example.com/\n" {
+		t.Errorf("unexpected preview url %q", string(data))
+	}
+	metadata := api.objects["/api/v1/namespaces/app-pr-7"]["metadata"].(map[string]interface{})
+	if metadata["annotations"].(map[string]interface{})[previewURLAnnotation] != "https://app-pr-7.preview.example.com/" {
+		t.Errorf("preview url has not been annotated: %v", metadata)
+	}
+	if metadata["labels"].(map[string]interface{})[previewLabel] != "true" {
+		t.Errorf("namespace labels have been lost: %v", metadata)
+	}
+}
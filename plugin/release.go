@@ -0,0 +1,243 @@
+package plugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// helmRelease is a release as listed by `helm list --output json`
+type helmRelease struct {
+	Name       string `json:"Name"`
+	Namespace  string `json:"Namespace"`
+	Updated    string `json:"Updated"`
+	Status     string `json:"Status"`
+	Chart      string `json:"Chart"`
+	AppVersion string `json:"AppVersion"`
+}
+
+// releaseRevision is a revision as printed by `helm history --output json`,
+// and as written to output_file by the status and history commands
+type releaseRevision struct {
+	Release     string `json:"release"`
+	Revision    int    `json:"revision"`
+	Status      string `json:"status"`
+	Chart       string `json:"chart"`
+	AppVersion  string `json:"app_version"`
+	Updated     string `json:"updated"`
+	Description string `json:"description"`
+}
+
+// time formats used by helm 2 and helm 3 when printing release dates
+var helmTimeFormats = []string{
+	time.ANSIC,
+	"2006-01-02 15:04:05.999999999 -0700 MST",
+	time.RFC3339,
+}
+
+func parseHelmTime(s string) (time.Time, error) {
+	for _, format := range helmTimeFormats {
+		if t, err := time.ParseInLocation(format, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unknown time format: %s", s)
+}
+
+func doHelmList(p *Plugin, offset string) []string {
+	list := []string{
+		"list",
+		"--all",
+		"--output",
+		"json",
+	}
+	if offset != "" {
+		list = append(list, "--offset")
+		list = append(list, offset)
+	}
+	if p.Config.TillerNs != "" {
+		list = append(list, "--tiller-namespace")
+		list = append(list, p.Config.TillerNs)
+	}
+	return append(list, tlsFlags(p)...)
+}
+
+// listReleases returns every release known to helm. Helm 2 lists them by
+// pages of 256, giving the release the next page starts from.
+func listReleases(p *Plugin) ([]helmRelease, error) {
+	releases := []helmRelease{}
+	offset := ""
+	for {
+		out, err := runCommandOutput(doHelmList(p, offset))
+		if err != nil {
+			return nil, fmt.Errorf("Error listing releases: %v", err)
+		}
+		out = bytes.TrimSpace(out)
+		if len(out) == 0 {
+			// helm 2 prints nothing when there are no releases
+			return releases, nil
+		}
+		if out[0] == '[' {
+			page := []helmRelease{}
+			if err := json.Unmarshal(out, &page); err != nil {
+				return nil, fmt.Errorf("Error parsing releases: %v", err)
+			}
+			return append(releases, page...), nil
+		}
+		list := struct {
+			Next     string        `json:"Next"`
+			Releases []helmRelease `json:"Releases"`
+		}{}
+		if err := json.Unmarshal(out, &list); err != nil {
+			return nil, fmt.Errorf("Error parsing releases: %v", err)
+		}
+		releases = append(releases, list.Releases...)
+		if list.Next == "" || list.Next == offset {
+			return releases, nil
+		}
+		offset = list.Next
+	}
+}
+
+func doHelmHistory(p *Plugin, max string) []string {
+	history := []string{
+		"history",
+		p.Config.Release,
+		"--output",
+		"json",
+	}
+	if max != "" {
+		history = append(history, "--max")
+		history = append(history, max)
+	}
+	if p.Config.TillerNs != "" {
+		history = append(history, "--tiller-namespace")
+		history = append(history, p.Config.TillerNs)
+	}
+	return append(history, tlsFlags(p)...)
+}
+
+// releaseHistory returns the revisions of the release, the oldest first.
+// Statuses are lower cased and dates turned into RFC 3339 so helm 2 and
+// helm 3 give the same output.
+func releaseHistory(p *Plugin, max string) ([]releaseRevision, error) {
+	if p.Config.Release == "" {
+		return nil, fmt.Errorf("Error: release is needed to read its history.")
+	}
+	out, err := runCommandOutput(doHelmHistory(p, max))
+	if err != nil {
+		return nil, fmt.Errorf("Error reading history of %s: %v", p.Config.Release, err)
+	}
+	revisions := []releaseRevision{}
+	if err := json.Unmarshal(out, &revisions); err != nil {
+		return nil, fmt.Errorf("Error parsing history of %s: %v", p.Config.Release, err)
+	}
+	for i := range revisions {
+		revisions[i].Release = p.Config.Release
+		revisions[i].Status = strings.ToLower(revisions[i].Status)
+		if updated, err := parseHelmTime(revisions[i].Updated); err == nil {
+			revisions[i].Updated = updated.Format(time.RFC3339)
+		}
+	}
+	return revisions, nil
+}
+
+// releaseStatus returns the latest revision of the release
+func releaseStatus(p *Plugin) (releaseRevision, error) {
+	revisions, err := releaseHistory(p, "1")
+	if err != nil {
+		return releaseRevision{}, err
+	}
+	if len(revisions) == 0 {
+		return releaseRevision{}, fmt.Errorf("Error: release %s not found", p.Config.Release)
+	}
+	return revisions[len(revisions)-1], nil
+}
+
+func doHelmRollback(p *Plugin, revision int) []string {
+	rollback := []string{
+		"rollback",
+		p.Config.Release,
+		strconv.Itoa(revision),
+	}
+	if p.Config.TillerNs != "" {
+		rollback = append(rollback, "--tiller-namespace")
+		rollback = append(rollback, p.Config.TillerNs)
+	}
+	if p.Config.Wait {
+		rollback = append(rollback, "--wait")
+	}
+	if p.Config.Timeout != "" {
+		rollback = append(rollback, "--timeout")
+		rollback = append(rollback, p.Config.Timeout)
+	}
+	return append(rollback, tlsFlags(p)...)
+}
+
+// rollbackRelease rolls the release back to the last revision before the
+// latest one that has been deployed, skipping the failed ones
+func rollbackRelease(p *Plugin) error {
+	revisions, err := releaseHistory(p, "")
+	if err != nil {
+		return err
+	}
+	previous := 0
+	for i := 0; i < len(revisions)-1; i++ {
+		revision := revisions[i]
+		switch releaseStatusName(revision.Status) {
+		case "deployed", "superseded":
+			previous = revision.Revision
+		}
+	}
+	if previous == 0 {
+		return fmt.Errorf("Error: release %s has no previous deployed revision to roll back to", p.Config.Release)
+	}
+	fmt.Printf("rolling %s back to revision %d\n", p.Config.Release, previous)
+	if err := runCommand(doHelmRollback(p, previous)); err != nil {
+		return fmt.Errorf("Error rolling back %s: %v", p.Config.Release, err)
+	}
+	return nil
+}
+
+// outputFile is where the status and history commands write their result
+func outputFile(p *Plugin) string {
+	if p.Config.OutputFile != "" {
+		return p.Config.OutputFile
+	}
+	return "helm-" + p.Config.HelmCommand + ".json"
+}
+
+// inspectRelease runs the status or history command, printing the result
+// and writing it as JSON to output_file
+func inspectRelease(p *Plugin) error {
+	var result interface{}
+	switch p.Config.HelmCommand {
+	case "status":
+		status, err := releaseStatus(p)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s revision %d %s (%s, app version %s) updated %s\n",
+			status.Release, status.Revision, status.Status, status.Chart, status.AppVersion, status.Updated)
+		result = status
+	case "history":
+		revisions, err := releaseHistory(p, "")
+		if err != nil {
+			return err
+		}
+		for _, revision := range revisions {
+			fmt.Printf("%d\t%s\t%s\t%s\t%s\n", revision.Revision, revision.Updated, revision.Status, revision.Chart, revision.Description)
+		}
+		result = revisions
+	}
+
+	data, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(outputFile(p), append(data, '\n'), 0644)
+}
@@ -0,0 +1,96 @@
+package plugin
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testHistory = `[
+{"revision":1,"updated":"Mon Jan  7 10:00:00 2019","status":"SUPERSEDED","chart":"app-0.1.0","description":"Install complete"},
+{"revision":2,"updated":"Tue Jan  8 10:00:00 2019","status":"DEPLOYED","chart":"app-0.2.0","app_version":"1.1","description":"Upgrade complete"}
+]`
+
+func TestReleaseStatus(t *testing.T) {
+	dir, err := ioutil.TempDir("", "release")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	calls, restore := fakeHelm(t, `echo '[{"revision":2,"updated":"Tue Jan  8 10:00:00 2019","status":"DEPLOYED","chart":"app-0.2.0","app_version":"1.1","description":"Upgrade complete"}]'`)
+	defer restore()
+
+	plugin := &Plugin{
+		Config: Config{
+			HelmCommand: "status",
+			Release:     "app",
+			TillerNs:    "tiller",
+			OutputFile:  filepath.Join(dir, "status.json"),
+		},
+	}
+	if err := inspectRelease(plugin); err != nil {
+		t.Fatal(err)
+	}
+
+	data, _ := ioutil.ReadFile(calls)
+	if string(data) != "history app --output json --max 1 --tiller-namespace tiller\n" {
+		t.Errorf("unexpected helm calls:\n%s", data)
+	}
+	status := releaseRevision{}
+	data, _ = ioutil.ReadFile(plugin.Config.OutputFile)
+	if err := json.Unmarshal(data, &status); err != nil {
+		t.Fatal(err)
+	}
+	updated := time.Date(2019, 1, 8, 10, 0, 0, 0, time.Local).Format(time.RFC3339)
+	expected := releaseRevision{Release: "app", Revision: 2, Status: "deployed", Chart: "app-0.2.0", AppVersion: "1.1", Updated: updated, Description: "Upgrade complete"}
+	if status != expected {
+		t.Errorf("unexpected status %+v", status)
+	}
+}
+
+func TestReleaseHistory(t *testing.T) {
+	_, restore := fakeHelm(t, "echo '"+testHistory+"'")
+	defer restore()
+
+	revisions, err := releaseHistory(&Plugin{Config: Config{Release: "app"}}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revisions) != 2 || revisions[0].Revision != 1 || revisions[0].Status != "superseded" || revisions[1].Chart != "app-0.2.0" {
+		t.Errorf("unexpected history %+v", revisions)
+	}
+}
+
+func TestOutputFile(t *testing.T) {
+	if file := outputFile(&Plugin{Config: Config{HelmCommand: "history"}}); file != "helm-history.json" {
+		t.Errorf("unexpected default output file %s", file)
+	}
+}
+
+func TestListReleasesPages(t *testing.T) {
+	calls, restore := fakeHelm(t, `case "$*" in
+*"--offset app-3"*) echo '{"Releases":[{"Name":"app-3"}]}' ;;
+*"--offset app-2"*) echo '{"Next":"app-3","Releases":[{"Name":"app-2"}]}' ;;
+*) echo '{"Next":"app-2","Releases":[{"Name":"app-1"}]}' ;;
+esac`)
+	defer restore()
+
+	releases, err := listReleases(&Plugin{Config: Config{TillerNs: "tiller"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(releases) != 3 || releases[0].Name != "app-1" || releases[2].Name != "app-3" {
+		t.Errorf("unexpected releases %+v", releases)
+	}
+	data, _ := ioutil.ReadFile(calls)
+	expected := "list --all --output json --tiller-namespace tiller\n" +
+		"list --all --output json --offset app-2 --tiller-namespace tiller\n" +
+		"list --all --output json --offset app-3 --tiller-namespace tiller\n"
+	if string(data) != expected {
+		t.Errorf("unexpected helm calls:\n%s", data)
+	}
+}
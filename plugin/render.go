@@ -0,0 +1,211 @@
+package plugin
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// podSpec holds the parts of a pod spec the manifest rules look at
+type podSpec struct {
+	Containers     []renderedContainer `yaml:"containers"`
+	InitContainers []renderedContainer `yaml:"initContainers"`
+	Volumes        []struct {
+		Name     string `yaml:"name"`
+		HostPath *struct {
+			Path string `yaml:"path"`
+		} `yaml:"hostPath"`
+	} `yaml:"volumes"`
+}
+
+type renderedContainer struct {
+	Name            string `yaml:"name"`
+	Image           string `yaml:"image"`
+	SecurityContext *struct {
+		Privileged *bool `yaml:"privileged"`
+	} `yaml:"securityContext"`
+	Resources struct {
+		Limits map[string]interface{} `yaml:"limits"`
+	} `yaml:"resources"`
+}
+
+// renderedObject is an object of the rendered chart, with the pod spec of
+// pods, workloads and cron jobs
+type renderedObject struct {
+	Kind     string `yaml:"kind"`
+	Metadata struct {
+		Name string `yaml:"name"`
+	} `yaml:"metadata"`
+	Spec struct {
+		podSpec  `yaml:",inline"`
+		Template struct {
+			Spec podSpec `yaml:"spec"`
+		} `yaml:"template"`
+		JobTemplate struct {
+			Spec struct {
+				Template struct {
+					Spec podSpec `yaml:"spec"`
+				} `yaml:"template"`
+			} `yaml:"spec"`
+		} `yaml:"jobTemplate"`
+	} `yaml:"spec"`
+}
+
+// podSpec returns the pod spec of the object, nil if it has none
+func (o *renderedObject) podSpec() *podSpec {
+	switch o.Kind {
+	case "Pod":
+		return &o.Spec.podSpec
+	case "Deployment", "StatefulSet", "DaemonSet", "ReplicaSet", "ReplicationController", "Job":
+		return &o.Spec.Template.Spec
+	case "CronJob":
+		return &o.Spec.JobTemplate.Spec.Template.Spec
+	}
+	return nil
+}
+
+func (pol *policy) hasManifestRules() bool {
+	return pol.DenyPrivileged || pol.DenyLatestTag || pol.RequireLimits || pol.DenyHostPath || len(pol.AllowedRegistries) > 0
+}
+
+func doHelmTemplate(p *Plugin, chart string) []string {
+	template := []string{
+		"template",
+		chart,
+	}
+	if p.Config.Release != "" {
+		template = append(template, "--name")
+		template = append(template, p.Config.Release)
+	}
+	if p.Config.Namespace != "" {
+		template = append(template, "--namespace")
+		template = append(template, p.Config.Namespace)
+	}
+	return append(template, valuesFlags(p)...)
+}
+
+// renderChart renders the chart with the values of the release, fetching
+// it first when it comes from a repository
+func renderChart(p *Plugin) (string, error) {
+	chart := p.Config.Chart
+	if _, err := os.Stat(chart); err != nil {
+		archive, cleanup, err := fetchChart(p)
+		if err != nil {
+			return "", fmt.Errorf("Error fetching chart %s: %v", chart, err)
+		}
+		defer cleanup()
+		chart = archive
+	}
+	out, err := runCommandOutput(doHelmTemplate(p, chart))
+	if err != nil {
+		return "", fmt.Errorf("Error rendering chart %s: %v", p.Config.Chart, err)
+	}
+	return string(out), nil
+}
+
+// imageName splits an image into its full repository name, e.g.
+// docker.io/library/nginx, and its tag
+func imageName(image string) (string, string) {
+	name, tag := image, ""
+	if i := strings.Index(name, "@"); i >= 0 {
+		// pinned by digest
+		name, tag = name[:i], name[i+1:]
+	} else if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name, tag = name[:i], name[i+1:]
+	}
+	parts := strings.Split(name, "/")
+	if len(parts) == 1 || !(strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		if len(parts) == 1 {
+			name = "library/" + name
+		}
+		name = "docker.io/" + name
+	}
+	return name, tag
+}
+
+// allowedImage tells if the image comes from one of the registries, given
+// as a registry host or a repository prefix
+func allowedImage(registries []string, name string) bool {
+	for _, registry := range registries {
+		registry = strings.TrimSuffix(registry, "/")
+		if name == registry || strings.HasPrefix(name, registry+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// manifestViolations lists the rules broken by each object of the manifest
+func (pol *policy) manifestViolations(manifest string) ([]string, error) {
+	violations := []string{}
+	for _, document := range documentSeparator.Split(manifest, -1) {
+		if strings.TrimSpace(document) == "" {
+			continue
+		}
+		obj := &renderedObject{}
+		if err := yaml.Unmarshal([]byte(document), obj); err != nil {
+			return nil, fmt.Errorf("Error parsing rendered manifest: %v", err)
+		}
+		spec := obj.podSpec()
+		if spec == nil {
+			continue
+		}
+		resource := obj.Kind + "/" + obj.Metadata.Name
+
+		if pol.DenyHostPath {
+			for _, volume := range spec.Volumes {
+				if volume.HostPath != nil {
+					violations = append(violations, fmt.Sprintf("%s: volume %s mounts host path %s", resource, volume.Name, volume.HostPath.Path))
+				}
+			}
+		}
+		containers := append(append([]renderedContainer{}, spec.InitContainers...), spec.Containers...)
+		for _, container := range containers {
+			prefix := fmt.Sprintf("%s: container %s", resource, container.Name)
+			if pol.DenyPrivileged && container.SecurityContext != nil && container.SecurityContext.Privileged != nil && *container.SecurityContext.Privileged {
+				violations = append(violations, prefix+" is privileged")
+			}
+			name, tag := imageName(container.Image)
+			if pol.DenyLatestTag && (tag == "" || tag == "latest") {
+				violations = append(violations, fmt.Sprintf("%s uses the latest tag of %s", prefix, container.Image))
+			}
+			if len(pol.AllowedRegistries) > 0 && !allowedImage(pol.AllowedRegistries, name) {
+				violations = append(violations, fmt.Sprintf("%s image %s is not from an allowed registry", prefix, container.Image))
+			}
+			if pol.RequireLimits {
+				for _, resourceName := range []string{"cpu", "memory"} {
+					if _, ok := container.Resources.Limits[resourceName]; !ok {
+						violations = append(violations, fmt.Sprintf("%s has no %s limit", prefix, resourceName))
+					}
+				}
+			}
+		}
+	}
+	return violations, nil
+}
+
+// checkManifests renders the chart and fails the build when its objects
+// break the manifest rules of the policy, listing every violation
+func checkManifests(p *Plugin) error {
+	pol, err := loadPolicy(p.Config.Policy)
+	if err != nil {
+		return err
+	}
+	if !pol.hasManifestRules() {
+		return nil
+	}
+	manifest, err := renderChart(p)
+	if err != nil {
+		return err
+	}
+	violations, err := pol.manifestViolations(manifest)
+	if err != nil {
+		return err
+	}
+	if len(violations) == 0 {
+		return nil
+	}
+	return fmt.Errorf("Error: the rendered chart breaks the policy:\n - %s", strings.Join(violations, "\n - "))
+}
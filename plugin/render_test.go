@@ -0,0 +1,131 @@
+package plugin
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+const testRendered = `---
+# Source: app/templates/service.yaml
+apiVersion: v1
+kind: Service
+metadata:
+  name: app
+---
+# Source: app/templates/deployment.yaml
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    spec:
+      initContainers:
+        - name: migrate
+          image: registry.example.com/app/migrate:1.2
+          resources:
+            limits: {cpu: 100m, memory: 64Mi}
+      containers:
+        - name: app
+          image: nginx
+          securityContext:
+            privileged: true
+      volumes:
+        - name: docker
+          hostPath:
+            path: /var/run/docker.sock
+---
+# Source: app/templates/pod.yaml
+apiVersion: v1
+kind: Pod
+metadata:
+  name: debug
+spec:
+  containers:
+    - name: debug
+      image: registry.example.com/tools/debug@sha256:0123
+      resources:
+        limits: {cpu: 100m, memory: 64Mi}
+---
+# Source: app/templates/cronjob.yaml
+apiVersion: batch/v1beta1
+kind: CronJob
+metadata:
+  name: backup
+spec:
+  jobTemplate:
+    spec:
+      template:
+        spec:
+          containers:
+            - name: backup
+              image: quay.io/backup/tool:latest
+              resources:
+                limits: {cpu: 1}
+`
+
+func TestManifestViolations(t *testing.T) {
+	pol := &policy{
+		DenyPrivileged:    true,
+		DenyLatestTag:     true,
+		RequireLimits:     true,
+		DenyHostPath:      true,
+		AllowedRegistries: []string{"registry.example.com", "quay.io/backup"},
+	}
+	violations, err := pol.manifestViolations(testRendered)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"Deployment/app: volume docker mounts host path /var/run/docker.sock",
+		"Deployment/app: container app is privileged",
+		"Deployment/app: container app uses the latest tag of nginx",
+		"Deployment/app: container app image nginx is not from an allowed registry",
+		"Deployment/app: container app has no cpu limit",
+		"Deployment/app: container app has no memory limit",
+		"CronJob/backup: container backup uses the latest tag of quay.io/backup/tool:latest",
+		"CronJob/backup: container backup has no memory limit",
+	}
+	if strings.Join(violations, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("unexpected violations:\n%s", strings.Join(violations, "\n"))
+	}
+}
+
+func TestImageName(t *testing.T) {
+	tests := map[string][2]string{
+		"nginx":                           {"docker.io/library/nginx", ""},
+		"myorg/app:1.0":                   {"docker.io/myorg/app", "1.0"},
+		"localhost:5000/app:1.0":          {"localhost:5000/app", "1.0"},
+		"gcr.io/project/app@sha256:abcd":  {"gcr.io/project/app", "sha256:abcd"},
+		"registry.example.com/app:latest": {"registry.example.com/app", "latest"},
+	}
+	for image, expected := range tests {
+		if name, tag := imageName(image); name != expected[0] || tag != expected[1] {
+			t.Errorf("%s: got %s and %s", image, name, tag)
+		}
+	}
+}
+
+func TestCheckManifests(t *testing.T) {
+	calls, restore := fakeHelm(t, "cat <<'EOF'\n"+testRendered+"EOF")
+	defer restore()
+
+	plugin := &Plugin{
+		Config: Config{
+			Chart:     ".",
+			Release:   "app",
+			Namespace: "web",
+			Values:    "image.tag=1.0",
+			Policy:    "deny_privileged: true",
+		},
+	}
+	err := checkManifests(plugin)
+	if err == nil || !strings.Contains(err.Error(), "Deployment/app: container app is privileged") {
+		t.Fatalf("unexpected error %v", err)
+	}
+	data, _ := ioutil.ReadFile(calls)
+	if string(data) != "template . --name app --namespace web --set image.tag=1.0\n" {
+		t.Errorf("unexpected helm calls:\n%s", data)
+	}
+}
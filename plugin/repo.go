@@ -0,0 +1,103 @@
+package plugin
+
+import (
+	"net/url"
+	"path/filepath"
+	"strings"
+)
+
+// repoConfig holds a chart repository definition together with the
+// credentials needed to use it
+type repoConfig struct {
+	Name                  string
+	URL                   string
+	Username              string
+	Password              string
+	CACert                string
+	Cert                  string
+	Key                   string
+	InsecureSkipTLSVerify bool
+}
+
+// resolveRepo parses a `name=url` repo definition and resolves its
+// credentials from the REPO_<NAME>_* prefixed secrets. Credentials embedded
+// in the url are moved out of it so they don't end up in the logs.
+func resolveRepo(p *Plugin, repo string) (*repoConfig, error) {
+	repoMap, err := parseRepo(unQuote(repo))
+	if err != nil {
+		return nil, err
+	}
+	r := &repoConfig{
+		Name:                  repoMap["name"],
+		URL:                   repoMap["url"],
+		InsecureSkipTLSVerify: containsString(p.Config.RepoInsecureSkipTLSVerify, repoMap["name"]),
+	}
+
+	if u, err := url.Parse(r.URL); err == nil && u.User != nil {
+		r.Username = u.User.Username()
+		r.Password, _ = u.User.Password()
+		u.User = nil
+		r.URL = u.String()
+	}
+
+	key := repoSecretKey(r.Name)
+	if username := resolveEnvVar("${"+key+"_USERNAME}", p.Config.Prefix, p.Config.Debug); username != "" {
+		r.Username = username
+	}
+	if password := resolveEnvVar("${"+key+"_PASSWORD}", p.Config.Prefix, p.Config.Debug); password != "" {
+		r.Password = password
+	}
+	r.CACert = resolveEnvVar("${"+key+"_CA_CERT}", p.Config.Prefix, p.Config.Debug)
+	r.Cert = resolveEnvVar("${"+key+"_CERT}", p.Config.Prefix, p.Config.Debug)
+	r.Key = resolveEnvVar("${"+key+"_KEY}", p.Config.Prefix, p.Config.Debug)
+	return r, nil
+}
+
+// repoSecretKey returns the secret name prefix of a repo, e.g.
+// REPO_MY_CHARTS for my-charts
+func repoSecretKey(name string) string {
+	return "REPO_" + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+func (r *repoConfig) caFile() string {
+	return filepath.Join(HELM_HOME, "repository", "certs", r.Name, tlsCACertFile)
+}
+
+func (r *repoConfig) certFile() string {
+	return filepath.Join(HELM_HOME, "repository", "certs", r.Name, tlsCertFile)
+}
+
+func (r *repoConfig) keyFile() string {
+	return filepath.Join(HELM_HOME, "repository", "certs", r.Name, tlsKeyFile)
+}
+
+// writeFiles stores the repo certificates so they can be handed to helm
+func (r *repoConfig) writeFiles() error {
+	files := map[string]string{
+		r.caFile():   r.CACert,
+		r.certFile(): r.Cert,
+		r.keyFile():  r.Key,
+	}
+	for path, content := range files {
+		if content == "" {
+			continue
+		}
+		if err := writeSecretFile(path, decodePEM(content)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// maskArgs hides the values of the flags carrying credentials so the
+// command can be logged
+func maskArgs(args []string) []string {
+	masked := make([]string, len(args))
+	copy(masked, args)
+	for i := 1; i < len(masked); i++ {
+		if masked[i-1] == "--password" {
+			masked[i] = "********"
+		}
+	}
+	return masked
+}
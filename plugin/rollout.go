@@ -0,0 +1,314 @@
+package plugin
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const defaultRolloutTimeout = "5m"
+
+// how often workloads are checked while waiting for their rollout
+var rolloutPollInterval = 2 * time.Second
+
+// workloadResources maps the kinds verified to their API collection
+var workloadResources = map[string]string{
+	"Deployment":  "deployments",
+	"StatefulSet": "statefulsets",
+	"DaemonSet":   "daemonsets",
+}
+
+// workload holds the fields of deployments, statefulsets and daemonsets
+// needed to tell if their rollout is complete
+type workload struct {
+	Kind     string
+	Metadata struct {
+		Name       string `json:"name"`
+		Namespace  string `json:"namespace"`
+		Generation int64  `json:"generation"`
+	} `json:"metadata"`
+	Spec struct {
+		Replicas *int32 `json:"replicas"`
+		Selector struct {
+			MatchLabels map[string]string `json:"matchLabels"`
+		} `json:"selector"`
+		UpdateStrategy struct {
+			Type          string `json:"type"`
+			RollingUpdate *struct {
+				Partition *int32 `json:"partition"`
+			} `json:"rollingUpdate"`
+		} `json:"updateStrategy"`
+	} `json:"spec"`
+	Status struct {
+		ObservedGeneration     int64  `json:"observedGeneration"`
+		Replicas               int32  `json:"replicas"`
+		UpdatedReplicas        int32  `json:"updatedReplicas"`
+		ReadyReplicas          int32  `json:"readyReplicas"`
+		AvailableReplicas      int32  `json:"availableReplicas"`
+		CurrentRevision        string `json:"currentRevision"`
+		UpdateRevision         string `json:"updateRevision"`
+		DesiredNumberScheduled int32  `json:"desiredNumberScheduled"`
+		UpdatedNumberScheduled int32  `json:"updatedNumberScheduled"`
+		NumberAvailable        int32  `json:"numberAvailable"`
+		Conditions             []struct {
+			Type    string `json:"type"`
+			Reason  string `json:"reason"`
+			Message string `json:"message"`
+		} `json:"conditions"`
+	} `json:"status"`
+}
+
+func (w *workload) String() string {
+	return strings.ToLower(w.Kind) + "/" + w.Metadata.Name
+}
+
+// rolloutStatus tells if the rollout of the workload is complete, the
+// same way `kubectl rollout status` does, with a progress message
+func (w *workload) rolloutStatus() (bool, string, error) {
+	if w.Status.ObservedGeneration < w.Metadata.Generation {
+		return false, "waiting for the spec update to be observed", nil
+	}
+	replicas := int32(1)
+	if w.Spec.Replicas != nil {
+		replicas = *w.Spec.Replicas
+	}
+
+	switch w.Kind {
+	case "Deployment":
+		for _, condition := range w.Status.Conditions {
+			if condition.Type == "Progressing" && condition.Reason == "ProgressDeadlineExceeded" {
+				return false, "", fmt.Errorf("%s exceeded its progress deadline: %s", w, condition.Message)
+			}
+		}
+		if w.Status.UpdatedReplicas < replicas {
+			return false, fmt.Sprintf("%d of %d updated replicas", w.Status.UpdatedReplicas, replicas), nil
+		}
+		if w.Status.Replicas > w.Status.UpdatedReplicas {
+			return false, fmt.Sprintf("%d old replicas pending termination", w.Status.Replicas-w.Status.UpdatedReplicas), nil
+		}
+		if w.Status.AvailableReplicas < w.Status.UpdatedReplicas {
+			return false, fmt.Sprintf("%d of %d updated replicas available", w.Status.AvailableReplicas, w.Status.UpdatedReplicas), nil
+		}
+	case "StatefulSet":
+		if w.Spec.UpdateStrategy.Type == "OnDelete" {
+			return true, "pods are updated when deleted", nil
+		}
+		if w.Status.ReadyReplicas < replicas {
+			return false, fmt.Sprintf("%d of %d replicas ready", w.Status.ReadyReplicas, replicas), nil
+		}
+		if rolling := w.Spec.UpdateStrategy.RollingUpdate; rolling != nil && rolling.Partition != nil {
+			if expected := replicas - *rolling.Partition; w.Status.UpdatedReplicas < expected {
+				return false, fmt.Sprintf("%d of %d partitioned replicas updated", w.Status.UpdatedReplicas, expected), nil
+			}
+			return true, "partitioned rollout complete", nil
+		}
+		if w.Status.UpdateRevision != w.Status.CurrentRevision {
+			return false, fmt.Sprintf("%d of %d replicas updated", w.Status.UpdatedReplicas, replicas), nil
+		}
+	case "DaemonSet":
+		if w.Status.UpdatedNumberScheduled < w.Status.DesiredNumberScheduled {
+			return false, fmt.Sprintf("%d of %d pods updated", w.Status.UpdatedNumberScheduled, w.Status.DesiredNumberScheduled), nil
+		}
+		if w.Status.NumberAvailable < w.Status.DesiredNumberScheduled {
+			return false, fmt.Sprintf("%d of %d updated pods available", w.Status.NumberAvailable, w.Status.DesiredNumberScheduled), nil
+		}
+	}
+	return true, "rollout complete", nil
+}
+
+// releaseWorkloads returns the deployments, statefulsets and daemonsets of
+// the release manifest
+func releaseWorkloads(p *Plugin) ([]*workload, error) {
+	resources, err := releaseResources(p)
+	if err != nil {
+		return nil, err
+	}
+	workloads := []*workload{}
+	for _, resource := range resources {
+		if _, ok := workloadResources[resource.Kind]; !ok {
+			continue
+		}
+		w := &workload{Kind: resource.Kind}
+		w.Metadata.Name = resource.Metadata.Name
+		w.Metadata.Namespace = resource.Metadata.Namespace
+		if w.Metadata.Namespace == "" {
+			w.Metadata.Namespace = p.Config.Namespace
+		}
+		if w.Metadata.Namespace == "" {
+			w.Metadata.Namespace = "default"
+		}
+		workloads = append(workloads, w)
+	}
+	return workloads, nil
+}
+
+// refresh reads the current state of the workload. Each state is decoded
+// afresh, as the API server leaves out the status fields that are zero.
+func (w *workload) refresh(kube *kubeClient) error {
+	path := namespacedPath("/apis/apps/v1", w.Metadata.Namespace, workloadResources[w.Kind]) + "/" + w.Metadata.Name
+	current := workload{}
+	if err := kube.get(path, &current); err != nil {
+		return err
+	}
+	current.Kind = w.Kind
+	current.Metadata.Name = w.Metadata.Name
+	current.Metadata.Namespace = w.Metadata.Namespace
+	*w = current
+	return nil
+}
+
+// verifyRollout waits for every workload of the release to be rolled out,
+// printing their progress, and reports the replica sets and pods that are
+// stuck when rollout_timeout is exceeded
+func verifyRollout(p *Plugin) error {
+	timeout := p.Config.RolloutTimeout
+	if timeout == "" {
+		timeout = defaultRolloutTimeout
+	}
+	duration, err := time.ParseDuration(timeout)
+	if err != nil {
+		return fmt.Errorf("Error: invalid rollout_timeout %s: %v", timeout, err)
+	}
+
+	workloads, err := releaseWorkloads(p)
+	if err != nil {
+		return err
+	}
+	if len(workloads) == 0 {
+		fmt.Println("no workload to verify in release " + p.Config.Release)
+		return nil
+	}
+	kube, err := newKubeClient(p)
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(duration)
+	progress := map[string]string{}
+	for {
+		pending := []*workload{}
+		for _, w := range workloads {
+			if err := w.refresh(kube); err != nil {
+				return fmt.Errorf("Error reading %s: %v", w, err)
+			}
+			done, message, err := w.rolloutStatus()
+			if err != nil {
+				stuckPods(kube, w)
+				return fmt.Errorf("Error: rollout failed: %v", err)
+			}
+			if progress[w.String()] != message {
+				fmt.Printf("%s: %s\n", w, message)
+				progress[w.String()] = message
+			}
+			if !done {
+				pending = append(pending, w)
+			}
+		}
+		if len(pending) == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			names := []string{}
+			for _, w := range pending {
+				stuckPods(kube, w)
+				names = append(names, w.String())
+			}
+			return fmt.Errorf("Error: rollout of %s not complete after %s", strings.Join(names, ", "), timeout)
+		}
+		workloads = pending
+		time.Sleep(rolloutPollInterval)
+	}
+}
+
+type podList struct {
+	Items []struct {
+		Metadata struct {
+			Name string `json:"name"`
+		} `json:"metadata"`
+		Status struct {
+			Phase             string `json:"phase"`
+			ContainerStatuses []struct {
+				Name  string `json:"name"`
+				Ready bool   `json:"ready"`
+				State struct {
+					Waiting *struct {
+						Reason  string `json:"reason"`
+						Message string `json:"message"`
+					} `json:"waiting"`
+					Terminated *struct {
+						Reason   string `json:"reason"`
+						ExitCode int    `json:"exitCode"`
+					} `json:"terminated"`
+				} `json:"state"`
+			} `json:"containerStatuses"`
+		} `json:"status"`
+	} `json:"items"`
+}
+
+type replicaSetList struct {
+	Items []struct {
+		Metadata struct {
+			Name string `json:"name"`
+		} `json:"metadata"`
+		Spec struct {
+			Replicas int32 `json:"replicas"`
+		} `json:"spec"`
+		Status struct {
+			ReadyReplicas int32 `json:"readyReplicas"`
+		} `json:"status"`
+	} `json:"items"`
+}
+
+// labelSelector turns matchLabels into a label selector query
+func labelSelector(labels map[string]string) string {
+	selectors := []string{}
+	for k, v := range labels {
+		selectors = append(selectors, k+"="+v)
+	}
+	sort.Strings(selectors)
+	return url.QueryEscape(strings.Join(selectors, ","))
+}
+
+// stuckPods prints the replica sets and pods of the workload that are not
+// ready, with the reason their containers are waiting
+func stuckPods(kube *kubeClient, w *workload) {
+	if len(w.Spec.Selector.MatchLabels) == 0 {
+		return
+	}
+	selector := "?labelSelector=" + labelSelector(w.Spec.Selector.MatchLabels)
+
+	if w.Kind == "Deployment" {
+		replicaSets := replicaSetList{}
+		if err := kube.get(namespacedPath("/apis/apps/v1", w.Metadata.Namespace, "replicasets")+selector, &replicaSets); err == nil {
+			for _, rs := range replicaSets.Items {
+				if rs.Spec.Replicas > 0 && rs.Status.ReadyReplicas < rs.Spec.Replicas {
+					fmt.Printf("%s: replicaset/%s has %d of %d replicas ready\n", w, rs.Metadata.Name, rs.Status.ReadyReplicas, rs.Spec.Replicas)
+				}
+			}
+		}
+	}
+
+	pods := podList{}
+	if err := kube.get(namespacedPath("/api/v1", w.Metadata.Namespace, "pods")+selector, &pods); err != nil {
+		return
+	}
+	for _, pod := range pods.Items {
+		for _, container := range pod.Status.ContainerStatuses {
+			if container.Ready {
+				continue
+			}
+			reason := pod.Status.Phase
+			if waiting := container.State.Waiting; waiting != nil {
+				reason = strings.TrimSpace(waiting.Reason + " " + waiting.Message)
+			} else if terminated := container.State.Terminated; terminated != nil {
+				reason = fmt.Sprintf("%s (exit code %d)", terminated.Reason, terminated.ExitCode)
+			}
+			fmt.Printf("%s: pod/%s container %s not ready: %s\n", w, pod.Metadata.Name, container.Name, reason)
+		}
+		if len(pod.Status.ContainerStatuses) == 0 && pod.Status.Phase != "Running" {
+			fmt.Printf("%s: pod/%s is %s\n", w, pod.Metadata.Name, pod.Status.Phase)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package plugin
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testManifest = `---
+# Source: app/templates/service.yaml
+apiVersion: v1
+kind: Service
+metadata:
+  name: app
+---
+# Source: app/templates/deployment.yaml
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+---
+# Source: app/templates/worker.yaml
+apiVersion: apps/v1
+kind: StatefulSet
+metadata:
+  name: worker
+  namespace: jobs
+`
+
+func testWorkload(t *testing.T, kind string, obj string) *workload {
+	w := &workload{Kind: kind}
+	if err := json.Unmarshal([]byte(obj), w); err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+func TestRolloutStatus(t *testing.T) {
+	tests := []struct {
+		kind string
+		obj  string
+		done bool
+	}{
+		{"Deployment", `{"metadata":{"generation":2},"status":{"observedGeneration":1}}`, false},
+		{"Deployment", `{"metadata":{"generation":2},"spec":{"replicas":3},"status":{"observedGeneration":2,"replicas":4,"updatedReplicas":3,"availableReplicas":3}}`, false},
+		{"Deployment", `{"metadata":{"generation":2},"spec":{"replicas":3},"status":{"observedGeneration":2,"replicas":3,"updatedReplicas":3,"availableReplicas":2}}`, false},
+		{"Deployment", `{"metadata":{"generation":2},"spec":{"replicas":3},"status":{"observedGeneration":2,"replicas":3,"updatedReplicas":3,"availableReplicas":3}}`, true},
+		{"StatefulSet", `{"spec":{"replicas":2},"status":{"readyReplicas":2,"currentRevision":"a","updateRevision":"b"}}`, false},
+		{"StatefulSet", `{"spec":{"replicas":2},"status":{"readyReplicas":2,"currentRevision":"b","updateRevision":"b"}}`, true},
+		{"StatefulSet", `{"spec":{"replicas":3,"updateStrategy":{"rollingUpdate":{"partition":2}}},"status":{"readyReplicas":3,"updatedReplicas":1}}`, true},
+		{"DaemonSet", `{"status":{"desiredNumberScheduled":3,"updatedNumberScheduled":3,"numberAvailable":2}}`, false},
+		{"DaemonSet", `{"status":{"desiredNumberScheduled":3,"updatedNumberScheduled":3,"numberAvailable":3}}`, true},
+	}
+	for _, test := range tests {
+		done, message, err := testWorkload(t, test.kind, test.obj).rolloutStatus()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if done != test.done {
+			t.Errorf("%s %s: done %v (%s), expected %v", test.kind, test.obj, done, message, test.done)
+		}
+	}
+
+	w := testWorkload(t, "Deployment", `{"status":{"conditions":[{"type":"Progressing","reason":"ProgressDeadlineExceeded"}]}}`)
+	if _, _, err := w.rolloutStatus(); err == nil {
+		t.Error("a deployment past its progress deadline should fail")
+	}
+}
+
+func TestReleaseWorkloads(t *testing.T) {
+	calls, restore := fakeHelm(t, "cat <<'EOF'\n"+testManifest+"EOF")
+	defer restore()
+
+	workloads, err := releaseWorkloads(&Plugin{Config: Config{Release: "app", Namespace: "web"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(workloads) != 2 || workloads[0].String() != "deployment/app" || workloads[0].Metadata.Namespace != "web" ||
+		workloads[1].String() != "statefulset/worker" || workloads[1].Metadata.Namespace != "jobs" {
+		t.Errorf("unexpected workloads %v", workloads)
+	}
+	data, _ := ioutil.ReadFile(calls)
+	if string(data) != "get manifest app\n" {
+		t.Errorf("unexpected helm calls:\n%s", data)
+	}
+}
+
+func TestVerifyRollout(t *testing.T) {
+	api, server := newFakeKubeAPI()
+	defer server.Close()
+
+	api.objects["/apis/apps/v1/namespaces/web/deployments/app"] = map[string]interface{}{
+		"metadata": map[string]interface{}{"name": "app", "generation": 1},
+		"spec":     map[string]interface{}{"replicas": 1, "selector": map[string]interface{}{"matchLabels": map[string]interface{}{"app": "app"}}},
+		"status":   map[string]interface{}{"observedGeneration": 1, "replicas": 1, "updatedReplicas": 1, "availableReplicas": 1},
+	}
+	api.objects["/apis/apps/v1/namespaces/jobs/statefulsets/worker"] = map[string]interface{}{
+		"metadata": map[string]interface{}{"name": "worker"},
+		"spec":     map[string]interface{}{"replicas": 1, "selector": map[string]interface{}{"matchLabels": map[string]interface{}{"app": "worker"}}},
+		"status":   map[string]interface{}{"readyReplicas": 0},
+	}
+	api.objects["/api/v1/namespaces/jobs/pods/worker-0"] = map[string]interface{}{
+		"metadata": map[string]interface{}{"name": "worker-0", "labels": map[string]interface{}{"app": "worker"}},
+	}
+	_, restore := fakeHelm(t, "cat <<'EOF'\n"+testManifest+"EOF")
+	defer restore()
+
+	previous := rolloutPollInterval
+	rolloutPollInterval = 10 * time.Millisecond
+	defer func() { rolloutPollInterval = previous }()
+
+	plugin := &Plugin{Config: Config{APIServer: server.URL, Release: "app", Namespace: "web", RolloutTimeout: "50ms"}}
+	err := verifyRollout(plugin)
+	if err == nil || !strings.Contains(err.Error(), "statefulset/worker") || strings.Contains(err.Error(), "deployment/app") {
+		t.Fatalf("the stuck statefulset should be reported, got %v", err)
+	}
+	if api.requests[len(api.requests)-1] != "GET /api/v1/namespaces/jobs/pods" {
+		t.Errorf("stuck pods should have been listed: %v", api.requests)
+	}
+
+	api.objects["/apis/apps/v1/namespaces/jobs/statefulsets/worker"]["status"] = map[string]interface{}{"readyReplicas": 1}
+	if err := verifyRollout(plugin); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRefreshWorkloadDropsMissingStatus(t *testing.T) {
+	api, server := newFakeKubeAPI()
+	defer server.Close()
+	kube, err := newKubeClient(&Plugin{Config: Config{APIServer: server.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := "/apis/apps/v1/namespaces/web/deployments/app"
+	api.objects[path] = map[string]interface{}{
+		"metadata": map[string]interface{}{"name": "app", "generation": 1},
+		"spec":     map[string]interface{}{"replicas": 2},
+		"status":   map[string]interface{}{"observedGeneration": 1, "replicas": 2, "updatedReplicas": 2, "availableReplicas": 2},
+	}
+	w := &workload{Kind: "Deployment"}
+	w.Metadata.Name = "app"
+	w.Metadata.Namespace = "web"
+	if err := w.refresh(kube); err != nil {
+		t.Fatal(err)
+	}
+	if done, message, _ := w.rolloutStatus(); !done {
+		t.Fatalf("the first rollout should be complete: %s", message)
+	}
+
+	// recreated pods crashing: availableReplicas is left out when it drops to 0
+	api.objects[path] = map[string]interface{}{
+		"metadata": map[string]interface{}{"name": "app", "generation": 2},
+		"spec":     map[string]interface{}{"replicas": 2},
+		"status":   map[string]interface{}{"observedGeneration": 2, "replicas": 2, "updatedReplicas": 2},
+	}
+	if err := w.refresh(kube); err != nil {
+		t.Fatal(err)
+	}
+	if done, message, _ := w.rolloutStatus(); done {
+		t.Errorf("no replica is available, got %s", message)
+	}
+	if w.Kind != "Deployment" || w.Metadata.Namespace != "web" || w.Status.AvailableReplicas != 0 {
+		t.Errorf("unexpected workload %+v", w)
+	}
+}
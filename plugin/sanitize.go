@@ -0,0 +1,65 @@
+package plugin
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+)
+
+const (
+	// helm 2 refuses longer release names, as they are used in resource names
+	maxReleaseLength   = 53
+	maxNamespaceLength = 63
+	nameHashLength     = 6
+)
+
+var invalidNameChars = regexp.MustCompile(`[^a-z0-9-]+`)
+var repeatedDashes = regexp.MustCompile(`-{2,}`)
+
+// sanitizeName turns name into a valid DNS-1123 label of at most max
+// characters, e.g. feature/JIRA-12_new_UI gives feature-jira-12-new-ui.
+// Names that have to be truncated get a short hash of the original name
+// appended so they remain unique.
+func sanitizeName(name string, max int) (string, error) {
+	sanitized := strings.ToLower(name)
+	sanitized = invalidNameChars.ReplaceAllString(sanitized, "-")
+	sanitized = repeatedDashes.ReplaceAllString(sanitized, "-")
+	sanitized = strings.Trim(sanitized, "-")
+	if sanitized == "" {
+		return "", fmt.Errorf("Error: %q can't be turned into a valid name", name)
+	}
+	if len(sanitized) > max {
+		sum := sha256.Sum256([]byte(name))
+		hash := hex.EncodeToString(sum[:])[:nameHashLength]
+		sanitized = strings.TrimRight(sanitized[:max-nameHashLength-1], "-") + "-" + hash
+	}
+	return sanitized, nil
+}
+
+// sanitizeNames makes the release and namespace valid names
+func sanitizeNames(p *Plugin) error {
+	if p.Config.Release != "" {
+		release, err := sanitizeName(p.Config.Release, maxReleaseLength)
+		if err != nil {
+			return err
+		}
+		if p.Config.Debug && release != p.Config.Release {
+			log.Printf("release %s renamed to %s\n", p.Config.Release, release)
+		}
+		p.Config.Release = release
+	}
+	if p.Config.Namespace != "" {
+		namespace, err := sanitizeName(p.Config.Namespace, maxNamespaceLength)
+		if err != nil {
+			return err
+		}
+		if p.Config.Debug && namespace != p.Config.Namespace {
+			log.Printf("namespace %s renamed to %s\n", p.Config.Namespace, namespace)
+		}
+		p.Config.Namespace = namespace
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package plugin
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSanitizeName(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{name: "master", expected: "master"},
+		{name: "feature/JIRA-12_new_UI", expected: "feature-jira-12-new-ui"},
+		{name: "--Release..Name--", expected: "release-name"},
+	}
+	for _, test := range tests {
+		result, err := sanitizeName(test.name, maxReleaseLength)
+		if err != nil {
+			t.Errorf("unexpected error for %s: %v", test.name, err)
+		}
+		if result != test.expected {
+			t.Errorf("Result is %s and we expected %s", result, test.expected)
+		}
+	}
+
+	if _, err := sanitizeName("___", maxReleaseLength); err == nil {
+		t.Error("expected an error for a name without valid characters")
+	}
+}
+
+func TestSanitizeNameTruncates(t *testing.T) {
+	long := "feature/" + strings.Repeat("very-long-branch-name-", 4)
+	other := "feature/" + strings.Repeat("very-long-branch-name-", 4) + "2"
+
+	first, _ := sanitizeName(long, maxReleaseLength)
+	second, _ := sanitizeName(other, maxReleaseLength)
+	if len(first) > maxReleaseLength || len(second) > maxReleaseLength {
+		t.Errorf("names have not been truncated: %s %s", first, second)
+	}
+	if first == second {
+		t.Errorf("truncated names are not unique: %s", first)
+	}
+	again, _ := sanitizeName(long, maxReleaseLength)
+	if again != first {
+		t.Errorf("truncated names are not stable: %s %s", first, again)
+	}
+	if strings.HasSuffix(first[:len(first)-nameHashLength], "--") {
+		t.Errorf("truncated name has repeated dashes: %s", first)
+	}
+}
+
+func TestSanitizeNames(t *testing.T) {
+	plugin := &Plugin{
+		Config: Config{
+			Release:   "feature/JIRA-12_new_UI",
+			Namespace: "Preview_Envs",
+		},
+	}
+	if err := sanitizeNames(plugin); err != nil {
+		t.Fatal(err)
+	}
+	if plugin.Config.Release != "feature-jira-12-new-ui" || plugin.Config.Namespace != "preview-envs" {
+		t.Errorf("unexpected names %s %s", plugin.Config.Release, plugin.Config.Namespace)
+	}
+}
@@ -0,0 +1,188 @@
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// smokeTest is an HTTP check run after the upgrade
+type smokeTest struct {
+	URL       string `json:"url"`
+	Status    int    `json:"status"`
+	Body      string `json:"body"`
+	JSONPath  string `json:"json_path"`
+	JSONValue string `json:"json_value"`
+	Retries   *int   `json:"retries"`
+	Interval  string `json:"interval"`
+	Timeout   string `json:"timeout"`
+	retries   int
+	interval  time.Duration
+	client    *http.Client
+}
+
+const (
+	defaultSmokeRetries  = 10
+	defaultSmokeInterval = "5s"
+	defaultSmokeTimeout  = "10s"
+)
+
+// parseSmokeTests reads smoke_tests, a JSON list of checks or urls, or
+// urls separated by commas, which is how drone passes a list of strings
+func parseSmokeTests(s string) ([]*smokeTest, error) {
+	entries := []json.RawMessage{}
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "[") {
+		if err := json.Unmarshal([]byte(s), &entries); err != nil {
+			return nil, fmt.Errorf("Error parsing smoke_tests: %v", err)
+		}
+	} else {
+		for _, url := range strings.Split(s, ",") {
+			if url = strings.TrimSpace(url); url != "" {
+				entry, _ := json.Marshal(url)
+				entries = append(entries, entry)
+			}
+		}
+	}
+	tests := []*smokeTest{}
+	for _, entry := range entries {
+		test := &smokeTest{}
+		if err := json.Unmarshal(entry, &test.URL); err != nil {
+			if err := json.Unmarshal(entry, test); err != nil {
+				return nil, fmt.Errorf("Error parsing smoke_tests: %v", err)
+			}
+		}
+		if test.URL == "" {
+			return nil, fmt.Errorf("Error: smoke test without url in %s", string(entry))
+		}
+		if test.Status == 0 {
+			test.Status = http.StatusOK
+		}
+		// retries: 0 makes a single attempt
+		test.retries = defaultSmokeRetries
+		if test.Retries != nil {
+			if *test.Retries < 0 {
+				return nil, fmt.Errorf("Error: invalid retries %d for %s", *test.Retries, test.URL)
+			}
+			test.retries = *test.Retries
+		}
+		if test.Interval == "" {
+			test.Interval = defaultSmokeInterval
+		}
+		if test.Timeout == "" {
+			test.Timeout = defaultSmokeTimeout
+		}
+		var err error
+		if test.interval, err = time.ParseDuration(test.Interval); err != nil {
+			return nil, fmt.Errorf("Error: invalid interval %s for %s: %v", test.Interval, test.URL, err)
+		}
+		timeout, err := time.ParseDuration(test.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("Error: invalid timeout %s for %s: %v", test.Timeout, test.URL, err)
+		}
+		test.client = &http.Client{Timeout: timeout}
+		tests = append(tests, test)
+	}
+	return tests, nil
+}
+
+// check requests the url once and tells why the response isn't expected
+func (s *smokeTest) check() error {
+	resp, err := s.client.Get(s.URL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != s.Status {
+		return fmt.Errorf("status %d, expected %d", resp.StatusCode, s.Status)
+	}
+	if s.Body != "" && !strings.Contains(string(body), s.Body) {
+		return fmt.Errorf("body doesn't contain %q", s.Body)
+	}
+	if s.JSONPath != "" {
+		var doc interface{}
+		if err := json.Unmarshal(body, &doc); err != nil {
+			return fmt.Errorf("body isn't JSON: %v", err)
+		}
+		value, ok := jsonPath(doc, s.JSONPath)
+		if !ok {
+			return fmt.Errorf("%s not found", s.JSONPath)
+		}
+		if s.JSONValue != "" && fmt.Sprint(value) != s.JSONValue {
+			return fmt.Errorf("%s is %v, expected %s", s.JSONPath, value, s.JSONValue)
+		}
+	}
+	return nil
+}
+
+// run checks the url until it succeeds or the retries are exhausted
+func (s *smokeTest) run() error {
+	var err error
+	attempts := s.retries + 1
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if err = s.check(); err == nil {
+			fmt.Printf("smoke test %s passed\n", s.URL)
+			return nil
+		}
+		fmt.Printf("smoke test %s failed (attempt %d of %d): %v\n", s.URL, attempt, attempts, err)
+		if attempt < attempts {
+			time.Sleep(s.interval)
+		}
+	}
+	return fmt.Errorf("Error: smoke test %s failed: %v", s.URL, err)
+}
+
+// jsonPath looks up a dotted path such as $.status or items.0.name
+func jsonPath(doc interface{}, path string) (interface{}, bool) {
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	if path == "" {
+		return doc, true
+	}
+	for _, key := range strings.Split(path, ".") {
+		switch node := doc.(type) {
+		case map[string]interface{}:
+			value, ok := node[key]
+			if !ok {
+				return nil, false
+			}
+			doc = value
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil, false
+			}
+			doc = node[i]
+		default:
+			return nil, false
+		}
+	}
+	return doc, true
+}
+
+// runSmokeTests runs every smoke test, rolling the release back to its
+// previous revision when one fails and smoke_rollback is set
+func runSmokeTests(p *Plugin) error {
+	tests, err := parseSmokeTests(p.Config.SmokeTests)
+	if err != nil {
+		return err
+	}
+	for _, test := range tests {
+		if err := test.run(); err != nil {
+			if p.Config.SmokeRollback {
+				if rollbackErr := rollbackRelease(p); rollbackErr != nil {
+					return fmt.Errorf("%v, and rollback failed: %v", err, rollbackErr)
+				}
+			}
+			return err
+		}
+	}
+	return nil
+}
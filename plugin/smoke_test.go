@@ -0,0 +1,134 @@
+package plugin
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseSmokeTests(t *testing.T) {
+	tests, err := parseSmokeTests(`["http://app/health", {"url": "http://app/ready", "status": 204, "retries": 3, "interval": "1s"}]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tests) != 2 {
+		t.Fatalf("unexpected smoke tests %v", tests)
+	}
+	if tests[0].URL != "http://app/health" || tests[0].Status != 200 || tests[0].retries != defaultSmokeRetries {
+		t.Errorf("unexpected defaults %+v", tests[0])
+	}
+	if tests[1].Status != 204 || tests[1].retries != 3 || tests[1].interval.String() != "1s" {
+		t.Errorf("unexpected smoke test %+v", tests[1])
+	}
+
+	tests, err = parseSmokeTests("https://app.example.com/, https://app.example.com/health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tests) != 2 || tests[0].URL != "https://app.example.com/" || tests[1].URL != "https://app.example.com/health" || tests[1].Status != 200 {
+		t.Errorf("unexpected smoke tests from comma separated urls %+v", tests)
+	}
+	if _, err := parseSmokeTests(`[{"status": 200}]`); err == nil {
+		t.Error("smoke tests without url should be refused")
+	}
+}
+
+func TestSmokeTestCheck(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"status": "ok", "checks": [{"name": "db", "up": true}]}`))
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		check string
+		ok    bool
+	}{
+		{`"` + server.URL + `/health"`, true},
+		{`"` + server.URL + `/missing"`, false},
+		{`{"url": "` + server.URL + `/missing", "status": 404}`, true},
+		{`{"url": "` + server.URL + `/health", "body": "\"ok\""}`, true},
+		{`{"url": "` + server.URL + `/health", "body": "failing"}`, false},
+		{`{"url": "` + server.URL + `/health", "json_path": "$.status", "json_value": "ok"}`, true},
+		{`{"url": "` + server.URL + `/health", "json_path": "checks.0.up", "json_value": "true"}`, true},
+		{`{"url": "` + server.URL + `/health", "json_path": "checks.1.up"}`, false},
+	}
+	for _, test := range tests {
+		smoke, err := parseSmokeTests("[" + test.check + "]")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := smoke[0].check(); (err == nil) != test.ok {
+			t.Errorf("%s: unexpected result %v", test.check, err)
+		}
+	}
+}
+
+func TestRunSmokeTestsRollback(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	calls, restore := fakeHelm(t, `[ "$1" = history ] && echo '[{"revision":4,"status":"SUPERSEDED"},{"revision":5,"status":"FAILED"},{"revision":6,"status":"DEPLOYED"}]'
+exit 0`)
+	defer restore()
+
+	plugin := &Plugin{
+		Config: Config{
+			Release:       "app",
+			TillerNs:      "tiller",
+			Wait:          true,
+			SmokeTests:    `[{"url": "` + server.URL + `", "retries": 2, "interval": "1ms"}]`,
+			SmokeRollback: true,
+		},
+	}
+	err := runSmokeTests(plugin)
+	if err == nil || !strings.Contains(err.Error(), "status 503") {
+		t.Fatalf("the smoke test should fail, got %v", err)
+	}
+
+	data, _ := ioutil.ReadFile(calls)
+	expected := "history app --output json --tiller-namespace tiller\n" +
+		"rollback app 4 --tiller-namespace tiller --wait\n"
+	if string(data) != expected {
+		t.Errorf("unexpected helm calls:\n%s", data)
+	}
+}
+
+func TestSmokeTestRetries(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	tests, err := parseSmokeTests(`[{"url": "` + server.URL + `", "retries": 2, "interval": "1ms"}]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tests[0].run(); err == nil {
+		t.Fatal("the smoke test should fail")
+	}
+	if requests != 3 {
+		t.Errorf("expected the first attempt and 2 retries, got %d requests", requests)
+	}
+
+	requests = 0
+	tests, err = parseSmokeTests(`[{"url": "` + server.URL + `", "retries": 0}]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tests[0].run(); err == nil || requests != 1 {
+		t.Errorf("retries: 0 should make a single attempt, got %d requests: %v", requests, err)
+	}
+	if _, err := parseSmokeTests(`[{"url": "` + server.URL + `", "retries": -1}]`); err == nil {
+		t.Error("negative retries should be refused")
+	}
+}
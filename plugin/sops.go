@@ -0,0 +1,231 @@
+package plugin
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"gopkg.in/yaml.v2"
+)
+
+// sopsValue matches the values encrypted by sops, e.g.
+// ENC[AES256_GCM,data:...,iv:...,tag:...,type:str]
+var sopsValue = regexp.MustCompile(`^ENC\[AES256_GCM,data:([^,]*),iv:([^,]+),tag:([^,]+),type:(\w+)\]$`)
+
+// sopsMetadata is the part of the sops section of an encrypted file needed
+// to decrypt it with an age key
+type sopsMetadata struct {
+	Age []struct {
+		Recipient string `yaml:"recipient"`
+		Enc       string `yaml:"enc"`
+	} `yaml:"age"`
+}
+
+// sopsFile reads a values file, telling if sops encrypted it
+func sopsFile(path string) (yaml.MapSlice, *sopsMetadata, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		// e.g. values files given as urls, helm reads them
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	doc := yaml.MapSlice{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		// not for us to tell, helm will report it
+		return nil, nil, nil
+	}
+	for _, item := range doc {
+		if item.Key != "sops" {
+			continue
+		}
+		raw, err := yaml.Marshal(item.Value)
+		if err != nil {
+			return nil, nil, err
+		}
+		metadata := &sopsMetadata{}
+		if err := yaml.Unmarshal(raw, metadata); err != nil {
+			return nil, nil, fmt.Errorf("Invalid sops metadata in %s: %v", path, err)
+		}
+		return doc, metadata, nil
+	}
+	return nil, nil, nil
+}
+
+// sopsDataKey decrypts the data key of the file with one of the identities
+func sopsDataKey(metadata *sopsMetadata, identities []age.Identity) ([]byte, error) {
+	if len(metadata.Age) == 0 {
+		return nil, fmt.Errorf("the file isn't encrypted for an age key")
+	}
+	for _, recipient := range metadata.Age {
+		r, err := age.Decrypt(armor.NewReader(strings.NewReader(recipient.Enc)), identities...)
+		if err != nil {
+			continue
+		}
+		return ioutil.ReadAll(r)
+	}
+	return nil, fmt.Errorf("none of the age recipients of the file match the key")
+}
+
+// decryptSopsValue decrypts a value, authenticated by its path in the file
+func decryptSopsValue(value string, key []byte, path []string) (interface{}, error) {
+	match := sopsValue.FindStringSubmatch(value)
+	if match == nil {
+		return value, nil
+	}
+	data, err := base64.StdEncoding.DecodeString(match[1])
+	if err != nil {
+		return nil, err
+	}
+	iv, err := base64.StdEncoding.DecodeString(match[2])
+	if err != nil {
+		return nil, err
+	}
+	tag, err := base64.StdEncoding.DecodeString(match[3])
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCMWithNonceSize(block, len(iv))
+	if err != nil {
+		return nil, err
+	}
+	plain, err := gcm.Open(nil, iv, append(data, tag...), []byte(strings.Join(path, ":")+":"))
+	if err != nil {
+		return nil, fmt.Errorf("can't decrypt %s", strings.Join(path, "."))
+	}
+
+	switch match[4] {
+	case "int":
+		return strconv.Atoi(string(plain))
+	case "float":
+		return strconv.ParseFloat(string(plain), 64)
+	case "bool":
+		return strconv.ParseBool(string(plain))
+	}
+	return string(plain), nil
+}
+
+// decryptSopsTree decrypts every encrypted value of the document
+func decryptSopsTree(v interface{}, key []byte, path []string) (interface{}, error) {
+	switch v := v.(type) {
+	case yaml.MapSlice:
+		decrypted := yaml.MapSlice{}
+		for _, item := range v {
+			if len(path) == 0 && item.Key == "sops" {
+				continue
+			}
+			value, err := decryptSopsTree(item.Value, key, append(path, fmt.Sprint(item.Key)))
+			if err != nil {
+				return nil, err
+			}
+			decrypted = append(decrypted, yaml.MapItem{Key: item.Key, Value: value})
+		}
+		return decrypted, nil
+	case []interface{}:
+		decrypted := []interface{}{}
+		for _, item := range v {
+			// list items are authenticated by the path of the list
+			value, err := decryptSopsTree(item, key, path)
+			if err != nil {
+				return nil, err
+			}
+			decrypted = append(decrypted, value)
+		}
+		return decrypted, nil
+	case string:
+		return decryptSopsValue(v, key, path)
+	}
+	return v, nil
+}
+
+// decryptValuesFiles decrypts the values files encrypted by sops for an
+// age key, given as the SOPS_AGE_KEY secret, into temporary files readable
+// by their owner only, which are passed to helm instead. The returned
+// function removes them. Values are authenticated one by one; the sops
+// MAC of the whole file isn't checked.
+func decryptValuesFiles(p *Plugin) (func(), error) {
+	decrypted := []string{}
+	cleanup := func() {
+		for _, file := range decrypted {
+			os.Remove(file)
+		}
+	}
+	if p.Config.ValuesFiles == "" {
+		return cleanup, nil
+	}
+
+	var identities []age.Identity
+	files := strings.Split(p.Config.ValuesFiles, ",")
+	for i, file := range files {
+		doc, metadata, err := sopsFile(file)
+		if err != nil {
+			cleanup()
+			return func() {}, fmt.Errorf("Error reading values file %s: %v", file, err)
+		}
+		if metadata == nil {
+			continue
+		}
+
+		if identities == nil {
+			key := resolveEnvVar("${SOPS_AGE_KEY}", p.Config.Prefix, p.Config.Debug)
+			if key == "" {
+				cleanup()
+				return func() {}, fmt.Errorf("Error: the SOPS_AGE_KEY secret is needed to decrypt %s.", file)
+			}
+			if identities, err = age.ParseIdentities(strings.NewReader(key)); err != nil {
+				cleanup()
+				return func() {}, fmt.Errorf("Error parsing SOPS_AGE_KEY: %v", err)
+			}
+		}
+		dataKey, err := sopsDataKey(metadata, identities)
+		if err != nil {
+			cleanup()
+			return func() {}, fmt.Errorf("Error decrypting %s: %v", file, err)
+		}
+		plain, err := decryptSopsTree(doc, dataKey, nil)
+		if err != nil {
+			cleanup()
+			return func() {}, fmt.Errorf("Error decrypting %s: %v", file, err)
+		}
+		data, err := yaml.Marshal(plain)
+		if err != nil {
+			cleanup()
+			return func() {}, err
+		}
+
+		// TempFile creates files readable by their owner only
+		tmp, err := ioutil.TempFile("", "values")
+		if err != nil {
+			cleanup()
+			return func() {}, err
+		}
+		decrypted = append(decrypted, tmp.Name())
+		_, err = tmp.Write(data)
+		if closeErr := tmp.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			cleanup()
+			return func() {}, fmt.Errorf("Error writing decrypted %s: %v", file, err)
+		}
+		if p.Config.Debug {
+			fmt.Printf("decrypted values file %s\n", file)
+		}
+		files[i] = tmp.Name()
+	}
+	p.Config.ValuesFiles = strings.Join(files, ",")
+	return cleanup, nil
+}
@@ -0,0 +1,141 @@
+package plugin
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+)
+
+// sopsEncrypt encrypts a value the way sops does
+func sopsEncrypt(t *testing.T, key []byte, value string, kind string, path string) string {
+	block, _ := aes.NewCipher(key)
+	iv := make([]byte, 32)
+	rand.Read(iv)
+	gcm, err := cipher.NewGCMWithNonceSize(block, len(iv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed := gcm.Seal(nil, iv, []byte(value), []byte(path))
+	data, tag := sealed[:len(sealed)-16], sealed[len(sealed)-16:]
+	return fmt.Sprintf("ENC[AES256_GCM,data:%s,iv:%s,tag:%s,type:%s]",
+		base64.StdEncoding.EncodeToString(data), base64.StdEncoding.EncodeToString(iv), base64.StdEncoding.EncodeToString(tag), kind)
+}
+
+// sopsEncryptedFile writes a values file encrypted for the identity
+func sopsEncryptedFile(t *testing.T, dir string, identity *age.X25519Identity) string {
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	armored := &bytes.Buffer{}
+	a := armor.NewWriter(armored)
+	w, err := age.Encrypt(a, identity.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(key)
+	w.Close()
+	a.Close()
+
+	content := fmt.Sprintf(`db:
+    password: %s
+    port: %s
+    hosts:
+        - %s
+replicaCount_unencrypted: 2
+sops:
+    age:
+        - recipient: %s
+          enc: |
+%s
+    version: 3.7.3
+`,
+		sopsEncrypt(t, key, "hunter2", "str", "db:password:"),
+		sopsEncrypt(t, key, "5432", "int", "db:port:"),
+		sopsEncrypt(t, key, "db.example.com", "str", "db:hosts:"),
+		identity.Recipient(),
+		"            "+strings.Replace(strings.TrimSpace(armored.String()), "\n", "\n            ", -1))
+
+	file := filepath.Join(dir, "secrets.production.yaml")
+	if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestDecryptValuesFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sops")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted := sopsEncryptedFile(t, dir, identity)
+	plain := filepath.Join(dir, "values.yaml")
+	ioutil.WriteFile(plain, []byte("image:\n  tag: stable\n"), 0644)
+
+	os.Setenv("PROD_SOPS_AGE_KEY", "# created: 2021-01-01\n"+identity.String()+"\n")
+	defer os.Unsetenv("PROD_SOPS_AGE_KEY")
+
+	plugin := &Plugin{Config: Config{Prefix: "PROD", ValuesFiles: plain + "," + encrypted}}
+	cleanup, err := decryptValuesFiles(plugin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := strings.Split(plugin.Config.ValuesFiles, ",")
+	if len(files) != 2 || files[0] != plain || files[1] == encrypted {
+		t.Fatalf("the encrypted file should have been replaced: %v", files)
+	}
+	info, err := os.Stat(files[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("the decrypted file should only be readable by its owner, mode is %v", info.Mode())
+	}
+	data, _ := ioutil.ReadFile(files[1])
+	expected := "db:\n  password: hunter2\n  port: 5432\n  hosts:\n  - db.example.com\nreplicaCount_unencrypted: 2\n"
+	if string(data) != expected {
+		t.Errorf("unexpected decrypted values:\n%s", data)
+	}
+
+	cleanup()
+	if _, err := os.Stat(files[1]); !os.IsNotExist(err) {
+		t.Error("the decrypted file should have been removed")
+	}
+}
+
+func TestDecryptValuesFilesWrongKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sops")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	identity, _ := age.GenerateX25519Identity()
+	other, _ := age.GenerateX25519Identity()
+	encrypted := sopsEncryptedFile(t, dir, identity)
+
+	os.Setenv("SOPS_AGE_KEY", other.String())
+	defer os.Unsetenv("SOPS_AGE_KEY")
+
+	_, err = decryptValuesFiles(&Plugin{Config: Config{ValuesFiles: encrypted}})
+	if err == nil || !strings.Contains(err.Error(), "none of the age recipients") {
+		t.Errorf("unexpected error %v", err)
+	}
+}
@@ -0,0 +1,147 @@
+package plugin
+
+import (
+	"fmt"
+	"log"
+)
+
+const defaultTillerNs = "kube-system"
+
+// tillerNamespace returns the namespace Tiller runs in
+func tillerNamespace(p *Plugin) string {
+	if p.Config.TillerNs != "" {
+		return p.Config.TillerNs
+	}
+	return defaultTillerNs
+}
+
+// tillerManagedNamespaces returns the namespaces Tiller gets a role in: the
+// configured ones, or the release namespace, plus its own namespace where it
+// stores the releases
+func tillerManagedNamespaces(p *Plugin) []string {
+	namespaces := []string{tillerNamespace(p)}
+	managed := p.Config.TillerNamespaces
+	if len(managed) == 0 && p.Config.Namespace != "" {
+		managed = []string{p.Config.Namespace}
+	}
+	for _, namespace := range managed {
+		if !containsString(namespaces, namespace) {
+			namespaces = append(namespaces, namespace)
+		}
+	}
+	return namespaces
+}
+
+// bootstrapTiller creates the service account Tiller runs as, and grants it
+// either cluster-admin or a role in each namespace it manages
+func bootstrapTiller(p *Plugin) error {
+	kube, err := newKubeClient(p)
+	if err != nil {
+		return err
+	}
+	sa := p.Config.TillerServiceAccount
+	tillerNs := tillerNamespace(p)
+
+	serviceAccount := map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "ServiceAccount",
+		"metadata": map[string]interface{}{
+			"name":      sa,
+			"namespace": tillerNs,
+		},
+	}
+	err = kube.get(namespacedPath("/api/v1", tillerNs, "serviceaccounts")+"/"+sa, nil)
+	if isNotFound(err) {
+		err = kube.create(namespacedPath("/api/v1", tillerNs, "serviceaccounts"), serviceAccount)
+	}
+	if err != nil {
+		return fmt.Errorf("Error creating Tiller service account: %v", err)
+	}
+
+	subjects := []interface{}{
+		map[string]interface{}{
+			"kind":      "ServiceAccount",
+			"name":      sa,
+			"namespace": tillerNs,
+		},
+	}
+
+	if p.Config.TillerClusterAdmin {
+		name := sa + "-cluster-admin"
+		if p.Config.Debug {
+			log.Println("binding cluster-admin to Tiller service account " + sa)
+		}
+		binding := map[string]interface{}{
+			"apiVersion": "rbac.authorization.k8s.io/v1",
+			"kind":       "ClusterRoleBinding",
+			"metadata": map[string]interface{}{
+				"name": name,
+			},
+			"roleRef": map[string]interface{}{
+				"apiGroup": "rbac.authorization.k8s.io",
+				"kind":     "ClusterRole",
+				"name":     "cluster-admin",
+			},
+			"subjects": subjects,
+		}
+		if err := kube.apply("/apis/rbac.authorization.k8s.io/v1/clusterrolebindings", name, binding); err != nil {
+			return fmt.Errorf("Error binding cluster-admin to Tiller: %v", err)
+		}
+		return nil
+	}
+
+	name := sa + "-manager"
+	for _, namespace := range tillerManagedNamespaces(p) {
+		if p.Config.Debug {
+			log.Printf("granting Tiller service account %s access to namespace %s\n", sa, namespace)
+		}
+		role := map[string]interface{}{
+			"apiVersion": "rbac.authorization.k8s.io/v1",
+			"kind":       "Role",
+			"metadata": map[string]interface{}{
+				"name":      name,
+				"namespace": namespace,
+			},
+			"rules": []interface{}{
+				map[string]interface{}{
+					"apiGroups": []string{"*"},
+					"resources": []string{"*"},
+					"verbs":     []string{"*"},
+				},
+			},
+		}
+		rolesPath := namespacedPath("/apis/rbac.authorization.k8s.io/v1", namespace, "roles")
+		if err := kube.apply(rolesPath, name, role); err != nil {
+			return fmt.Errorf("Error creating Tiller role in %s: %v", namespace, err)
+		}
+
+		binding := map[string]interface{}{
+			"apiVersion": "rbac.authorization.k8s.io/v1",
+			"kind":       "RoleBinding",
+			"metadata": map[string]interface{}{
+				"name":      name,
+				"namespace": namespace,
+			},
+			"roleRef": map[string]interface{}{
+				"apiGroup": "rbac.authorization.k8s.io",
+				"kind":     "Role",
+				"name":     name,
+			},
+			"subjects": subjects,
+		}
+		bindingsPath := namespacedPath("/apis/rbac.authorization.k8s.io/v1", namespace, "rolebindings")
+		if err := kube.apply(bindingsPath, name, binding); err != nil {
+			return fmt.Errorf("Error creating Tiller role binding in %s: %v", namespace, err)
+		}
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
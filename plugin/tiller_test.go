@@ -0,0 +1,89 @@
+package plugin
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBootstrapTiller(t *testing.T) {
+	api, server := newFakeKubeAPI()
+	defer server.Close()
+
+	plugin := &Plugin{
+		Config: Config{
+			APIServer:            server.URL,
+			Token:                "secret-token",
+			Namespace:            "staging",
+			TillerNs:             "tiller",
+			TillerServiceAccount: "tiller-deployer",
+		},
+	}
+	if err := bootstrapTiller(plugin); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"/api/v1/namespaces/tiller/serviceaccounts/tiller-deployer",
+		"/apis/rbac.authorization.k8s.io/v1/namespaces/tiller/roles/tiller-deployer-manager",
+		"/apis/rbac.authorization.k8s.io/v1/namespaces/tiller/rolebindings/tiller-deployer-manager",
+		"/apis/rbac.authorization.k8s.io/v1/namespaces/staging/roles/tiller-deployer-manager",
+		"/apis/rbac.authorization.k8s.io/v1/namespaces/staging/rolebindings/tiller-deployer-manager",
+	}
+	for _, path := range expected {
+		if _, ok := api.objects[path]; !ok {
+			t.Errorf("%s has not been created", path)
+		}
+	}
+	if len(api.objects) != len(expected) {
+		t.Errorf("expected %d objects, got %d", len(expected), len(api.objects))
+	}
+
+	// running it again updates the existing objects
+	if err := bootstrapTiller(plugin); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBootstrapTillerClusterAdmin(t *testing.T) {
+	api, server := newFakeKubeAPI()
+	defer server.Close()
+
+	plugin := &Plugin{
+		Config: Config{
+			APIServer:            server.URL,
+			Token:                "secret-token",
+			TillerServiceAccount: "tiller",
+			TillerClusterAdmin:   true,
+		},
+	}
+	if err := bootstrapTiller(plugin); err != nil {
+		t.Fatal(err)
+	}
+
+	binding, ok := api.objects["/apis/rbac.authorization.k8s.io/v1/clusterrolebindings/tiller-cluster-admin"]
+	if !ok {
+		t.Fatal("cluster-admin has not been bound to Tiller")
+	}
+	subject := binding["subjects"].([]interface{})[0].(map[string]interface{})
+	if subject["namespace"] != "kube-system" {
+		t.Errorf("Tiller service account expected in kube-system, got %v", subject["namespace"])
+	}
+	if _, ok := api.objects["/api/v1/namespaces/kube-system/serviceaccounts/tiller"]; !ok {
+		t.Error("Tiller service account has not been created")
+	}
+}
+
+func TestDetHelmInitServiceAccount(t *testing.T) {
+	plugin := &Plugin{
+		Config: Config{
+			TillerNs:             "tiller",
+			TillerServiceAccount: "tiller-deployer",
+			HistoryMax:           "20",
+		},
+	}
+	result := strings.Join(doHelmInit(plugin), " ")
+	expected := "init --tiller-namespace tiller --service-account tiller-deployer --wait --history-max 20"
+	if result != expected {
+		t.Errorf("Result is %s and we expected %s", result, expected)
+	}
+}
@@ -0,0 +1,149 @@
+package plugin
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// TLS material is written to the helm home using the file names helm itself
+// looks for, so a plain `helm --tls` in a later step finds them too.
+const (
+	tlsCACertFile     = "ca.pem"
+	tlsCertFile       = "cert.pem"
+	tlsKeyFile        = "key.pem"
+	tillerTLSCertFile = "tiller.cert.pem"
+	tillerTLSKeyFile  = "tiller.key.pem"
+)
+
+// resolveTLSSecrets fills the TLS settings from the prefixed secrets when
+// they have not been given explicitly
+func resolveTLSSecrets(p *Plugin) {
+	p.Config.TLSCACert = resolveSecret(p.Config.TLSCACert, "TLS_CA_CERT", p.Config.Prefix, p.Config.Debug)
+	p.Config.TLSCert = resolveSecret(p.Config.TLSCert, "TLS_CERT", p.Config.Prefix, p.Config.Debug)
+	p.Config.TLSKey = resolveSecret(p.Config.TLSKey, "TLS_KEY", p.Config.Prefix, p.Config.Debug)
+	p.Config.TillerTLSCert = resolveSecret(p.Config.TillerTLSCert, "TILLER_TLS_CERT", p.Config.Prefix, p.Config.Debug)
+	p.Config.TillerTLSKey = resolveSecret(p.Config.TillerTLSKey, "TILLER_TLS_KEY", p.Config.Prefix, p.Config.Debug)
+}
+
+// resolveSecret returns value with its env vars resolved, or the prefixed
+// secret called key when value is empty
+func resolveSecret(value string, key string, prefix string, debug bool) string {
+	if value == "" {
+		value = "${" + key + "}"
+	}
+	return resolveEnvVar(value, prefix, debug)
+}
+
+// writeTLSFiles stores the configured certificates in HELM_HOME so they can
+// be handed to helm as files
+func writeTLSFiles(p *Plugin) error {
+	resolveTLSSecrets(p)
+
+	files := map[string]string{
+		tlsCACertFile:     p.Config.TLSCACert,
+		tlsCertFile:       p.Config.TLSCert,
+		tlsKeyFile:        p.Config.TLSKey,
+		tillerTLSCertFile: p.Config.TillerTLSCert,
+		tillerTLSKeyFile:  p.Config.TillerTLSKey,
+	}
+	for name, content := range files {
+		if content == "" {
+			continue
+		}
+		if err := writeSecretFile(filepath.Join(HELM_HOME, name), decodePEM(content)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeSecretFile writes data readable only by the current user
+func writeSecretFile(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		return err
+	}
+	// WriteFile keeps the mode of an existing file
+	return os.Chmod(path, 0600)
+}
+
+// decodePEM accepts PEM data either as is or base64 encoded, as drone
+// secrets usually carry certificates the same way as KUBERNETES_CERTIFICATE
+func decodePEM(content string) []byte {
+	if strings.Contains(content, "-----BEGIN") {
+		return []byte(content)
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(content))
+	if err != nil {
+		return []byte(content)
+	}
+	return decoded
+}
+
+// tlsFlags returns the flags commands talking to Tiller need to use TLS
+func tlsFlags(p *Plugin) []string {
+	flags := []string{}
+	if !p.Config.TLS && !p.Config.TLSVerify {
+		return flags
+	}
+	flags = append(flags, "--tls")
+	if p.Config.TLSVerify {
+		flags = append(flags, "--tls-verify")
+	}
+	if p.Config.TLSCACert != "" {
+		flags = append(flags, "--tls-ca-cert")
+		flags = append(flags, filepath.Join(HELM_HOME, tlsCACertFile))
+	}
+	if p.Config.TLSCert != "" {
+		flags = append(flags, "--tls-cert")
+		flags = append(flags, filepath.Join(HELM_HOME, tlsCertFile))
+	}
+	if p.Config.TLSKey != "" {
+		flags = append(flags, "--tls-key")
+		flags = append(flags, filepath.Join(HELM_HOME, tlsKeyFile))
+	}
+	return flags
+}
+
+// tillerTLSFlags returns the flags `helm init` needs to install Tiller with
+// TLS enabled
+func tillerTLSFlags(p *Plugin) []string {
+	flags := []string{}
+	if p.Config.TillerTLSCert == "" || p.Config.TillerTLSKey == "" {
+		return flags
+	}
+	flags = append(flags, "--tiller-tls")
+	flags = append(flags, "--tiller-tls-cert")
+	flags = append(flags, filepath.Join(HELM_HOME, tillerTLSCertFile))
+	flags = append(flags, "--tiller-tls-key")
+	flags = append(flags, filepath.Join(HELM_HOME, tillerTLSKeyFile))
+	if p.Config.TLSVerify {
+		flags = append(flags, "--tiller-tls-verify")
+		if p.Config.TLSCACert != "" {
+			flags = append(flags, "--tls-ca-cert")
+			flags = append(flags, filepath.Join(HELM_HOME, tlsCACertFile))
+		}
+	}
+	return flags
+}
+
+// initTLSFlags returns the flags `helm init` needs to install Tiller with
+// TLS enabled and to talk to it over TLS, e.g. to wait for it or upgrade it
+func initTLSFlags(p *Plugin) []string {
+	flags := tillerTLSFlags(p)
+	client := tlsFlags(p)
+	for i := 0; i < len(client); i++ {
+		// the CA certificate is shared with the Tiller flags
+		if client[i] == "--tls-ca-cert" && containsString(flags, client[i]) {
+			i++
+			continue
+		}
+		flags = append(flags, client[i])
+	}
+	return flags
+}
@@ -0,0 +1,116 @@
+package plugin
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testPEM = "-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----\n"
+
+func TestWriteTLSFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helm-home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	HELM_HOME = filepath.Join(dir, ".helm")
+
+	os.Setenv("PROD_TLS_KEY", base64.StdEncoding.EncodeToString([]byte(testPEM)))
+	defer os.Unsetenv("PROD_TLS_KEY")
+
+	plugin := &Plugin{
+		Config: Config{
+			Prefix:    "PROD",
+			TLS:       true,
+			TLSCACert: testPEM,
+			TLSCert:   testPEM,
+		},
+	}
+	if err := writeTLSFiles(plugin); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{tlsCACertFile, tlsCertFile, tlsKeyFile} {
+		path := filepath.Join(HELM_HOME, name)
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("%s has not been written: %v", name, err)
+		}
+		if info.Mode().Perm() != 0600 {
+			t.Errorf("%s is written with mode %v, expected 0600", name, info.Mode().Perm())
+		}
+		data, _ := ioutil.ReadFile(path)
+		if string(data) != testPEM {
+			t.Errorf("%s contains %q, expected %q", name, string(data), testPEM)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(HELM_HOME, tillerTLSCertFile)); !os.IsNotExist(err) {
+		t.Errorf("Tiller certificate written without being configured")
+	}
+}
+
+func TestGetHelmCommandUpgradeTLS(t *testing.T) {
+	HELM_HOME = "/root/.helm"
+	plugin := &Plugin{
+		Config: Config{
+			HelmCommand: "upgrade",
+			Chart:       "./chart/test",
+			Release:     "test-release",
+			TillerNs:    "tiller",
+			TLSVerify:   true,
+			TLSCACert:   testPEM,
+			TLSCert:     testPEM,
+			TLSKey:      testPEM,
+		},
+	}
+	setHelmCommand(plugin)
+	res := strings.Join(plugin.command, " ")
+	expected := "upgrade --install test-release ./chart/test --tiller-namespace tiller --tls --tls-verify --tls-ca-cert /root/.helm/ca.pem --tls-cert /root/.helm/cert.pem --tls-key /root/.helm/key.pem"
+	if res != expected {
+		t.Errorf("Result is %s and we expected %s", res, expected)
+	}
+
+	plugin.Config.HelmCommand = "delete"
+	setHelmCommand(plugin)
+	res = strings.Join(plugin.command, " ")
+	expected = "delete test-release --tiller-namespace tiller --tls --tls-verify --tls-ca-cert /root/.helm/ca.pem --tls-cert /root/.helm/cert.pem --tls-key /root/.helm/key.pem"
+	if res != expected {
+		t.Errorf("Result is %s and we expected %s", res, expected)
+	}
+}
+
+func TestDetHelmInitTillerTLS(t *testing.T) {
+	HELM_HOME = "/root/.helm"
+	plugin := &Plugin{
+		Config: Config{
+			TLS:           true,
+			TLSVerify:     true,
+			TLSCACert:     testPEM,
+			TillerTLSCert: testPEM,
+			TillerTLSKey:  testPEM,
+		},
+	}
+	result := strings.Join(doHelmInit(plugin), " ")
+	expected := "init --tiller-tls --tiller-tls-cert /root/.helm/tiller.cert.pem --tiller-tls-key /root/.helm/tiller.key.pem --tiller-tls-verify --tls-ca-cert /root/.helm/ca.pem --tls --tls-verify"
+	if result != expected {
+		t.Errorf("Result is %s and we expected %s", result, expected)
+	}
+
+	plugin.Config.TLSCert = testPEM
+	plugin.Config.TLSKey = testPEM
+	result = strings.Join(doHelmInit(plugin), " ")
+	expected = "init --tiller-tls --tiller-tls-cert /root/.helm/tiller.cert.pem --tiller-tls-key /root/.helm/tiller.key.pem --tiller-tls-verify --tls-ca-cert /root/.helm/ca.pem --tls --tls-verify --tls-cert /root/.helm/cert.pem --tls-key /root/.helm/key.pem"
+	if result != expected {
+		t.Errorf("Result is %s and we expected %s", result, expected)
+	}
+
+	plugin.Config.ClientOnly = true
+	result = strings.Join(doHelmInit(plugin), " ")
+	if result != "init --client-only" {
+		t.Errorf("Tiller TLS flags passed to a client only init: %s", result)
+	}
+}
@@ -0,0 +1,353 @@
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/xeipuuv/gojsonschema"
+	"gopkg.in/yaml.v2"
+)
+
+// chartValues reads the default values and the values schema of the chart,
+// fetching it first when it comes from a repository
+func chartValues(p *Plugin) (map[string]interface{}, []byte, error) {
+	chart := p.Config.Chart
+	if _, err := os.Stat(chart); err != nil {
+		archive, cleanup, err := fetchChart(p)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Error fetching chart %s: %v", chart, err)
+		}
+		defer cleanup()
+		chart = archive
+	}
+	data, err := readChartFile(chart, "values.yaml")
+	if err != nil {
+		return nil, nil, err
+	}
+	values, err := parseValues(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error parsing values.yaml of %s: %v", p.Config.Chart, err)
+	}
+	schema, err := readChartFile(chart, "values.schema.json")
+	return values, schema, err
+}
+
+// parseValues reads a YAML values document into JSON friendly maps
+func parseValues(data []byte) (map[string]interface{}, error) {
+	var doc interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	values, ok := jsonValue(doc).(map[string]interface{})
+	if !ok {
+		values = map[string]interface{}{}
+	}
+	return values, nil
+}
+
+// jsonValue turns the map[interface{}]interface{} of yaml documents into
+// map[string]interface{}
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := map[string]interface{}{}
+		for k, value := range v {
+			m[fmt.Sprint(k)] = jsonValue(value)
+		}
+		return m
+	case []interface{}:
+		for i, value := range v {
+			v[i] = jsonValue(value)
+		}
+	}
+	return v
+}
+
+// mergeValues merges src into dst, the way helm overrides values
+func mergeValues(dst map[string]interface{}, src map[string]interface{}) {
+	for k, v := range src {
+		srcMap, srcIsMap := v.(map[string]interface{})
+		dstMap, dstIsMap := dst[k].(map[string]interface{})
+		if srcIsMap && dstIsMap {
+			mergeValues(dstMap, srcMap)
+			continue
+		}
+		dst[k] = v
+	}
+}
+
+// splitUnescaped splits s on sep, unless escaped by a backslash
+func splitUnescaped(s string, sep rune) []string {
+	parts := []string{}
+	current := []rune{}
+	escaped := false
+	depth := 0
+	for _, r := range s {
+		switch {
+		case escaped:
+			current = append(current, r)
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '{':
+			depth++
+			current = append(current, r)
+		case r == '}':
+			depth--
+			current = append(current, r)
+		case r == sep && depth <= 0:
+			parts = append(parts, string(current))
+			current = []rune{}
+		default:
+			current = append(current, r)
+		}
+	}
+	return append(parts, string(current))
+}
+
+// typedValue converts a --set value the way helm does
+func typedValue(s string) interface{} {
+	switch s {
+	case "true":
+		return true
+	case "false":
+		return false
+	case "null":
+		return nil
+	}
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return i
+	}
+	return s
+}
+
+// setValuePath sets a --set key such as image.tag or hosts[0].name
+func setValuePath(values map[string]interface{}, key string, value interface{}) error {
+	segments := strings.Split(key, ".")
+	var node interface{} = values
+	for i, segment := range segments {
+		last := i == len(segments)-1
+		name, index := segment, -1
+		if open := strings.Index(segment, "["); open >= 0 && strings.HasSuffix(segment, "]") {
+			n, err := strconv.Atoi(segment[open+1 : len(segment)-1])
+			if err != nil || n < 0 {
+				return fmt.Errorf("invalid index in %s", key)
+			}
+			name, index = segment[:open], n
+		}
+		m, ok := node.(map[string]interface{})
+		if !ok || name == "" {
+			return fmt.Errorf("invalid key %s", key)
+		}
+		if index < 0 {
+			if last {
+				m[name] = value
+				return nil
+			}
+			if _, ok := m[name].(map[string]interface{}); !ok {
+				m[name] = map[string]interface{}{}
+			}
+			node = m[name]
+			continue
+		}
+		list, _ := m[name].([]interface{})
+		for len(list) <= index {
+			list = append(list, nil)
+		}
+		m[name] = list
+		if last {
+			list[index] = value
+			return nil
+		}
+		if _, ok := list[index].(map[string]interface{}); !ok {
+			list[index] = map[string]interface{}{}
+		}
+		node = list[index]
+	}
+	return nil
+}
+
+// parseSetValues reads --set or, when typed is false, --set-string values
+func parseSetValues(s string, typed bool) (map[string]interface{}, error) {
+	values := map[string]interface{}{}
+	for _, pair := range splitUnescaped(s, ',') {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("%q is not a key=value pair", pair)
+		}
+		var value interface{} = kv[1]
+		if strings.HasPrefix(kv[1], "{") && strings.HasSuffix(kv[1], "}") {
+			list := []interface{}{}
+			for _, item := range splitUnescaped(kv[1][1:len(kv[1])-1], ',') {
+				if typed {
+					list = append(list, typedValue(item))
+				} else {
+					list = append(list, item)
+				}
+			}
+			value = list
+		} else if typed {
+			value = typedValue(kv[1])
+		}
+		if err := setValuePath(values, kv[0], value); err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
+// effectiveValues merges the chart values, the values files and the --set
+// values, the way helm computes the values of a release
+func effectiveValues(p *Plugin, defaults map[string]interface{}) (map[string]interface{}, error) {
+	values := map[string]interface{}{}
+	mergeValues(values, defaults)
+	if p.Config.ValuesFiles != "" {
+		for _, file := range strings.Split(p.Config.ValuesFiles, ",") {
+			data, err := ioutil.ReadFile(file)
+			if err != nil {
+				return nil, fmt.Errorf("Error reading values file %s: %v", file, err)
+			}
+			fileValues, err := parseValues(data)
+			if err != nil {
+				return nil, fmt.Errorf("Error parsing values file %s: %v", file, err)
+			}
+			mergeValues(values, fileValues)
+		}
+	}
+	if p.Config.Values != "" {
+		set, err := parseSetValues(unQuote(p.Config.Values), true)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing values: %v", err)
+		}
+		mergeValues(values, set)
+	}
+	if p.Config.StringValues != "" {
+		set, err := parseSetValues(unQuote(p.Config.StringValues), false)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing string_values: %v", err)
+		}
+		mergeValues(values, set)
+	}
+	return values, nil
+}
+
+// jsonPointer turns a gojsonschema context, e.g. (root).image.tag, into a
+// JSON pointer, e.g. /image/tag
+func jsonPointer(context *gojsonschema.JsonContext) string {
+	pointer := strings.TrimPrefix(context.String("/"), "(root)")
+	if pointer == "" {
+		return "/"
+	}
+	return pointer
+}
+
+// validateValues checks the values of the release against the chart
+// values.schema.json, or values_schema, listing every violation
+func validateValues(p *Plugin) error {
+	defaults, schema, err := chartValues(p)
+	if err != nil {
+		return err
+	}
+	if p.Config.ValuesSchema != "" {
+		if schema, err = ioutil.ReadFile(p.Config.ValuesSchema); err != nil {
+			return fmt.Errorf("Error reading values schema: %v", err)
+		}
+	}
+	if schema == nil {
+		if p.Config.Debug {
+			fmt.Println("no values schema in chart " + p.Config.Chart)
+		}
+		return nil
+	}
+	values, err := effectiveValues(p, defaults)
+	if err != nil {
+		return err
+	}
+
+	// the schema may be written in YAML as well
+	var schemaDoc interface{}
+	if err := yaml.Unmarshal(schema, &schemaDoc); err != nil {
+		return fmt.Errorf("Error parsing values schema: %v", err)
+	}
+	schemaJSON, err := json.Marshal(jsonValue(schemaDoc))
+	if err != nil {
+		return err
+	}
+	result, err := gojsonschema.Validate(gojsonschema.NewBytesLoader(schemaJSON), gojsonschema.NewGoLoader(values))
+	if err != nil {
+		return fmt.Errorf("Error validating values: %v", err)
+	}
+	if result.Valid() {
+		return nil
+	}
+	violations := []string{}
+	for _, violation := range result.Errors() {
+		violations = append(violations, jsonPointer(violation.Context())+": "+violation.Description())
+	}
+	return fmt.Errorf("Error: the values don't match the schema:\n - %s", strings.Join(violations, "\n - "))
+}
+
+// maskValues hides the values whose key looks like a secret, and the
+// secrets found in the other ones
+func maskValues(p *Plugin, v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		masked := map[string]interface{}{}
+		for k, value := range v {
+			if _, isMap := value.(map[string]interface{}); !isMap && value != nil && secretEnvNames.MatchString(k) {
+				masked[k] = "********"
+				continue
+			}
+			masked[k] = maskValues(p, value)
+		}
+		return masked
+	case []interface{}:
+		masked := make([]interface{}, len(v))
+		for i, value := range v {
+			masked[i] = maskValues(p, value)
+		}
+		return masked
+	case string:
+		return redact(p, v)
+	}
+	return v
+}
+
+// previewValues prints the values the chart receives, computed the way
+// helm does, with secrets masked. With values_file the unmasked values are
+// also written to that file, readable by its owner only.
+func previewValues(p *Plugin) error {
+	defaults, _, err := chartValues(p)
+	if err != nil {
+		return err
+	}
+	values, err := effectiveValues(p, defaults)
+	if err != nil {
+		return err
+	}
+	masked, err := yaml.Marshal(maskValues(p, values))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("values of %s:\n%s", p.Config.Chart, masked)
+
+	if p.Config.ValuesFile == "" {
+		return nil
+	}
+	data, err := yaml.Marshal(values)
+	if err != nil {
+		return err
+	}
+	if err := writeSecretFile(p.Config.ValuesFile, data); err != nil {
+		return fmt.Errorf("Error writing values to %s: %v", p.Config.ValuesFile, err)
+	}
+	fmt.Println("unmasked values written to " + p.Config.ValuesFile)
+	return nil
+}
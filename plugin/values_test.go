@@ -0,0 +1,184 @@
+package plugin
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testValuesSchema = `{
+  "type": "object",
+  "additionalProperties": false,
+  "required": ["image"],
+  "properties": {
+    "replicaCount": {"type": "integer", "minimum": 1},
+    "image": {
+      "type": "object",
+      "additionalProperties": false,
+      "properties": {
+        "repository": {"type": "string"},
+        "tag": {"type": "string"}
+      }
+    },
+    "hosts": {"type": "array", "items": {"type": "string"}}
+  }
+}`
+
+func testChart(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "chart")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestParseSetValues(t *testing.T) {
+	values, err := parseSetValues(`image.tag=1.0,replicaCount=2,debug=true,hosts={a.example.com,b.example.com},env[1].name=X,note=a\,b`, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"image":        map[string]interface{}{"tag": "1.0"},
+		"replicaCount": int64(2),
+		"debug":        true,
+		"hosts":        []interface{}{"a.example.com", "b.example.com"},
+		"env":          []interface{}{nil, map[string]interface{}{"name": "X"}},
+		"note":         "a,b",
+	}
+	if !reflect.DeepEqual(values, expected) {
+		t.Errorf("unexpected values %#v", values)
+	}
+
+	values, _ = parseSetValues("replicaCount=2", false)
+	if values["replicaCount"] != "2" {
+		t.Errorf("string values should not be typed: %#v", values)
+	}
+}
+
+func TestEffectiveValues(t *testing.T) {
+	chart := testChart(t, map[string]string{
+		"values.yaml":   "replicaCount: 1\nimage:\n  repository: nginx\n  tag: stable\n",
+		"override.yaml": "image:\n  tag: \"1.15\"\n",
+	})
+	defer os.RemoveAll(chart)
+
+	plugin := &Plugin{
+		Config: Config{
+			Chart:        chart,
+			ValuesFiles:  filepath.Join(chart, "override.yaml"),
+			Values:       "replicaCount=3",
+			StringValues: "image.repository=registry.example.com/nginx",
+		},
+	}
+	defaults, _, err := chartValues(plugin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values, err := effectiveValues(plugin, defaults)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"replicaCount": int64(3),
+		"image":        map[string]interface{}{"repository": "registry.example.com/nginx", "tag": "1.15"},
+	}
+	if !reflect.DeepEqual(values, expected) {
+		t.Errorf("unexpected values %#v", values)
+	}
+}
+
+func TestValidateValues(t *testing.T) {
+	chart := testChart(t, map[string]string{
+		"values.yaml":        "replicaCount: 1\nimage:\n  repository: nginx\n  tag: stable\n",
+		"values.schema.json": testValuesSchema,
+	})
+	defer os.RemoveAll(chart)
+
+	plugin := &Plugin{Config: Config{Chart: chart, Values: "replicaCount=2,image.tag=1.0"}}
+	if err := validateValues(plugin); err != nil {
+		t.Errorf("the values match the schema: %v", err)
+	}
+
+	plugin.Config.Values = "replicaCount=0,image.tga=1.0,hosts={a,2}"
+	err := validateValues(plugin)
+	if err == nil {
+		t.Fatal("the values don't match the schema")
+	}
+	for _, expected := range []string{"/replicaCount: ", "/image: Additional property tga is not allowed", "/hosts/1: "} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("%q should be reported in %v", expected, err)
+		}
+	}
+}
+
+func TestValidateValuesArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chart")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	archive := filepath.Join(dir, "app-1.0.0.tgz")
+	ioutil.WriteFile(archive, chartArchive(t, map[string]string{
+		"app/Chart.yaml":  "name: app\nversion: 1.0.0\n",
+		"app/values.yaml": "replicaCount: 1\n",
+	}), 0644)
+	schema := filepath.Join(dir, "schema.yaml")
+	ioutil.WriteFile(schema, []byte("properties:\n  replicaCount:\n    type: string\n"), 0644)
+
+	err = validateValues(&Plugin{Config: Config{Chart: archive, ValuesSchema: schema}})
+	if err == nil || !strings.Contains(err.Error(), "/replicaCount: Invalid type") {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestPreviewValues(t *testing.T) {
+	chart := testChart(t, map[string]string{
+		"values.yaml": "image:\n  tag: stable\ndb:\n  password: changeme\n  url: postgres://app:hunter2hunter2@db/app\n",
+	})
+	defer os.RemoveAll(chart)
+
+	os.Setenv("TEST_VALUES_DB_SECRET", "hunter2hunter2")
+	defer os.Unsetenv("TEST_VALUES_DB_SECRET")
+
+	plugin := &Plugin{
+		Config: Config{
+			Chart:      chart,
+			Values:     "image.tag=1.0",
+			ValuesFile: filepath.Join(chart, "private", "values.yaml"),
+		},
+	}
+	defaults, _, err := chartValues(plugin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values, _ := effectiveValues(plugin, defaults)
+	masked := maskValues(plugin, values).(map[string]interface{})
+	db := masked["db"].(map[string]interface{})
+	if db["password"] != "********" || db["url"] != "postgres://app:********@db/app" {
+		t.Errorf("secrets should be masked: %v", db)
+	}
+
+	if err := previewValues(plugin); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(plugin.Config.ValuesFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("the values file should only be readable by its owner, mode is %v", info.Mode())
+	}
+	data, _ := ioutil.ReadFile(plugin.Config.ValuesFile)
+	if !strings.Contains(string(data), "password: changeme") || !strings.Contains(string(data), "tag: \"1.0\"") {
+		t.Errorf("the values file should hold the unmasked values:\n%s", data)
+	}
+}
@@ -0,0 +1,175 @@
+package plugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// vault:<path>#<key> references to a Vault secret, e.g.
+// vault:secret/data/app#password
+var vaultReference = regexp.MustCompile(`vault:([\w./-]+)#([\w.-]+)`)
+
+// vaultClient reads secrets from the Vault HTTP API, reading every path
+// only once
+type vaultClient struct {
+	addr   string
+	token  string
+	client *http.Client
+	cache  map[string]map[string]interface{}
+}
+
+// vaultResponse is the part of a Vault answer the plugin needs
+type vaultResponse struct {
+	Data   map[string]interface{} `json:"data"`
+	Errors []string               `json:"errors"`
+	Auth   struct {
+		ClientToken string `json:"client_token"`
+	} `json:"auth"`
+}
+
+// newVaultClient creates a client for vault_addr, logged in with the
+// VAULT_TOKEN secret or, without it, with the VAULT_ROLE_ID and
+// VAULT_SECRET_ID AppRole secrets
+func newVaultClient(p *Plugin) (*vaultClient, error) {
+	addr := resolveSecret(p.Config.VaultAddr, "VAULT_ADDR", p.Config.Prefix, p.Config.Debug)
+	if addr == "" {
+		return nil, fmt.Errorf("Error: vault_addr is needed to resolve Vault references.")
+	}
+	v := &vaultClient{
+		addr:   strings.TrimSuffix(addr, "/"),
+		token:  resolveEnvVar("${VAULT_TOKEN}", p.Config.Prefix, p.Config.Debug),
+		client: &http.Client{Timeout: 30 * time.Second},
+		cache:  map[string]map[string]interface{}{},
+	}
+	if v.token != "" {
+		return v, nil
+	}
+
+	roleID := resolveEnvVar("${VAULT_ROLE_ID}", p.Config.Prefix, p.Config.Debug)
+	secretID := resolveEnvVar("${VAULT_SECRET_ID}", p.Config.Prefix, p.Config.Debug)
+	if roleID == "" {
+		return nil, fmt.Errorf("Error: VAULT_TOKEN or VAULT_ROLE_ID is needed to resolve Vault references.")
+	}
+	login := vaultResponse{}
+	body := map[string]string{"role_id": roleID, "secret_id": secretID}
+	if err := v.do("POST", "auth/approle/login", body, &login); err != nil {
+		return nil, fmt.Errorf("Error logging in to Vault: %v", err)
+	}
+	if login.Auth.ClientToken == "" {
+		return nil, fmt.Errorf("Error logging in to Vault: no token returned")
+	}
+	v.token = login.Auth.ClientToken
+	return v, nil
+}
+
+func (v *vaultClient) do(method string, path string, in interface{}, out *vaultResponse) error {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, v.addr+"/v1/"+strings.TrimPrefix(path, "/"), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if v.token != "" {
+		req.Header.Set("X-Vault-Token", v.token)
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	decoder := json.NewDecoder(resp.Body)
+	decoder.UseNumber()
+	if err := decoder.Decode(out); err != nil && resp.StatusCode < 300 {
+		return fmt.Errorf("reading %s: %v", path, err)
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("vault returned %d for %s: %s", resp.StatusCode, path, strings.Join(out.Errors, ", "))
+	}
+	return nil
+}
+
+// read returns the data of the secret at path. KV version 2 secrets are
+// wrapped in a data field next to their metadata.
+func (v *vaultClient) read(path string) (map[string]interface{}, error) {
+	if data, ok := v.cache[path]; ok {
+		return data, nil
+	}
+	secret := vaultResponse{}
+	if err := v.do("GET", path, nil, &secret); err != nil {
+		return nil, err
+	}
+	data := secret.Data
+	if inner, ok := data["data"].(map[string]interface{}); ok {
+		if _, ok := data["metadata"].(map[string]interface{}); ok {
+			data = inner
+		}
+	}
+	v.cache[path] = data
+	return data, nil
+}
+
+// lookup returns the key of the secret at path as a string
+func (v *vaultClient) lookup(path string, key string) (string, error) {
+	data, err := v.read(path)
+	if err != nil {
+		return "", err
+	}
+	value, ok := data[key]
+	if !ok || value == nil {
+		return "", fmt.Errorf("%s has no key %s", path, key)
+	}
+	switch value.(type) {
+	case map[string]interface{}, []interface{}:
+		return "", fmt.Errorf("%s#%s is not a single value", path, key)
+	}
+	return fmt.Sprint(value), nil
+}
+
+// resolveVaultSecrets replaces the vault:<path>#<key> references of values
+// and string_values with the secrets they point to. The secrets are escaped
+// so helm takes them as a single value.
+func resolveVaultSecrets(p *Plugin) error {
+	if !vaultReference.MatchString(p.Config.Values) && !vaultReference.MatchString(p.Config.StringValues) {
+		return nil
+	}
+	vault, err := newVaultClient(p)
+	if err != nil {
+		return err
+	}
+	escape := strings.NewReplacer(`\`, `\\`, `,`, `\,`)
+	resolve := func(s string) (string, error) {
+		var lookupErr error
+		resolved := vaultReference.ReplaceAllStringFunc(s, func(ref string) string {
+			match := vaultReference.FindStringSubmatch(ref)
+			secret, err := vault.lookup(match[1], match[2])
+			if err != nil {
+				if lookupErr == nil {
+					lookupErr = fmt.Errorf("Error resolving %s: %v", ref, err)
+				}
+				return ref
+			}
+			escaped := escape.Replace(secret)
+			// the escaped secret is the one found in the helm command
+			p.secrets = append(p.secrets, escaped, secret)
+			return escaped
+		})
+		return resolved, lookupErr
+	}
+
+	if p.Config.Values, err = resolve(p.Config.Values); err != nil {
+		return err
+	}
+	p.Config.StringValues, err = resolve(p.Config.StringValues)
+	return err
+}
@@ -0,0 +1,129 @@
+package plugin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// fakeVault serves KV secrets and AppRole logins, counting the reads
+func fakeVault(t *testing.T) (*httptest.Server, map[string]int) {
+	reads := map[string]int{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/auth/approle/login" {
+			var login map[string]string
+			json.NewDecoder(r.Body).Decode(&login)
+			if r.Method != "POST" || login["role_id"] != "my-role" || login["secret_id"] != "my-secret" {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"errors":["invalid role or secret ID"]}`))
+				return
+			}
+			w.Write([]byte(`{"auth":{"client_token":"approle-token"}}`))
+			return
+		}
+		if token := r.Header.Get("X-Vault-Token"); token != "root-token" && token != "approle-token" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errors":["permission denied"]}`))
+			return
+		}
+		reads[r.URL.Path]++
+		switch r.URL.Path {
+		case "/v1/secret/data/app":
+			w.Write([]byte(`{"data":{"data":{"password":"s3cr3t,pass","port":5432},"metadata":{"version":3}}}`))
+		case "/v1/kv/legacy":
+			w.Write([]byte(`{"data":{"api-key":"abcdef123"}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors":[]}`))
+		}
+	}))
+	return server, reads
+}
+
+func TestResolveVaultSecrets(t *testing.T) {
+	server, reads := fakeVault(t)
+	defer server.Close()
+	restore := setDroneEnv(map[string]string{"PROD_VAULT_TOKEN": "root-token", "DB": "app"})
+	defer restore()
+
+	plugin := &Plugin{
+		Config: Config{
+			APIServer:    "http://apiserver",
+			Token:        "token",
+			Prefix:       "PROD",
+			VaultAddr:    server.URL,
+			Values:       "db.password=vault:secret/data/${DB}#password,db.port=vault:secret/data/app#port,image.tag=1.0",
+			StringValues: "apiKey=vault:kv/legacy#api-key",
+		},
+	}
+	if err := resolveSecrets(plugin); err != nil {
+		t.Fatal(err)
+	}
+	if expected := `db.password=s3cr3t\,pass,db.port=5432,image.tag=1.0`; plugin.Config.Values != expected {
+		t.Errorf("expected values %s, got %s", expected, plugin.Config.Values)
+	}
+	if plugin.Config.StringValues != "apiKey=abcdef123" {
+		t.Errorf("unexpected string values %s", plugin.Config.StringValues)
+	}
+	if reads["/v1/secret/data/app"] != 1 {
+		t.Errorf("expected the secret to be read once, read %d times", reads["/v1/secret/data/app"])
+	}
+	if redacted := redact(plugin, "connecting with abcdef123"); strings.Contains(redacted, "abcdef123") {
+		t.Errorf("vault secret not redacted: %s", redacted)
+	}
+	setUpgradeCommand(plugin)
+	command := redact(plugin, strings.Join(plugin.command, " "))
+	for _, secret := range []string{"s3cr3t", "abcdef123"} {
+		if strings.Contains(command, secret) {
+			t.Errorf("vault secret %s not redacted from the helm command: %s", secret, command)
+		}
+	}
+	if !strings.Contains(command, "db.port=5432") {
+		t.Errorf("short vault secret should not be redacted: %s", command)
+	}
+	plugin.secrets = append(plugin.secrets, "on")
+	if redacted := redact(plugin, "Error: connection refused"); redacted != "Error: connection refused" {
+		t.Errorf("short vault secret mangled the output: %s", redacted)
+	}
+}
+
+func TestResolveVaultSecretsAppRole(t *testing.T) {
+	server, _ := fakeVault(t)
+	defer server.Close()
+	restore := setDroneEnv(map[string]string{"VAULT_ADDR": server.URL, "VAULT_ROLE_ID": "my-role", "VAULT_SECRET_ID": "my-secret"})
+	defer restore()
+
+	plugin := &Plugin{Config: Config{Values: "password=vault:secret/data/app#password"}}
+	if err := resolveVaultSecrets(plugin); err != nil {
+		t.Fatal(err)
+	}
+	if plugin.Config.Values != `password=s3cr3t\,pass` {
+		t.Errorf("unexpected values %s", plugin.Config.Values)
+	}
+}
+
+func TestResolveVaultSecretsErrors(t *testing.T) {
+	server, _ := fakeVault(t)
+	defer server.Close()
+
+	for values, env := range map[string]map[string]string{
+		"password=vault:secret/data/missing#password": {"VAULT_TOKEN": "root-token"},
+		"password=vault:secret/data/app#user":         {"VAULT_TOKEN": "root-token"},
+		"password=vault:secret/data/app#password":     {"VAULT_TOKEN": "wrong"},
+		"password=vault:kv/legacy#api-key":            {"VAULT_ROLE_ID": "my-role", "VAULT_SECRET_ID": "wrong"},
+	} {
+		restore := setDroneEnv(env)
+		plugin := &Plugin{Config: Config{VaultAddr: server.URL, Values: values}}
+		if err := resolveVaultSecrets(plugin); err == nil {
+			t.Errorf("expected an error resolving %s with %v", values, env)
+		}
+		restore()
+	}
+
+	plugin := &Plugin{Config: Config{Values: "image.tag=vault-1.0"}}
+	if err := resolveVaultSecrets(plugin); err != nil || plugin.Config.Values != "image.tag=vault-1.0" {
+		t.Errorf("values without references should be kept, got %s: %v", plugin.Config.Values, err)
+	}
+}
@@ -0,0 +1,124 @@
+package plugin
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func verifyKeyringFile() string {
+	return filepath.Join(HELM_HOME, "pubring.gpg")
+}
+
+// doHelmFetch returns the command downloading a repository chart into dest,
+// checking its provenance when verify is set
+func doHelmFetch(p *Plugin, dest string) []string {
+	fetch := []string{
+		"fetch",
+		p.Config.Chart,
+		"--destination",
+		dest,
+	}
+	if p.Config.Version != "" {
+		fetch = append(fetch, "--version")
+		fetch = append(fetch, p.Config.Version)
+	}
+	if p.Config.Verify {
+		fetch = append(fetch, "--verify")
+		fetch = append(fetch, "--keyring")
+		fetch = append(fetch, verifyKeyringFile())
+	}
+	return fetch
+}
+
+func doHelmVerify(chart string) []string {
+	return []string{
+		"verify",
+		chart,
+		"--keyring",
+		verifyKeyringFile(),
+	}
+}
+
+// fetchChart downloads a repository chart to a temporary folder, returning
+// the archive and a function removing it
+func fetchChart(p *Plugin) (string, func(), error) {
+	dir, err := ioutil.TempDir("", "chart")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+	if err := runCommand(doHelmFetch(p, dir)); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	archives, _ := filepath.Glob(filepath.Join(dir, "*.tgz"))
+	if len(archives) != 1 {
+		cleanup()
+		return "", nil, fmt.Errorf("fetching %s did not produce a chart archive", p.Config.Chart)
+	}
+	return archives[0], cleanup, nil
+}
+
+// verifyChart checks the chart provenance and digest when asked to. Charts
+// from repositories are fetched first, and the verified archive is the one
+// deployed. The returned function removes the fetched chart.
+func verifyChart(p *Plugin) (func(), error) {
+	noop := func() {}
+	if !p.Config.Verify && p.Config.ChartDigest == "" {
+		return noop, nil
+	}
+
+	if p.Config.Verify {
+		keyring := resolveEnvVar("${VERIFY_KEYRING}", p.Config.Prefix, p.Config.Debug)
+		if keyring == "" {
+			return noop, fmt.Errorf("Error: the VERIFY_KEYRING secret is needed to verify the chart.")
+		}
+		if err := writeSecretFile(verifyKeyringFile(), decodeKeyring(keyring)); err != nil {
+			return noop, fmt.Errorf("Error writing keyring: %v", err)
+		}
+	}
+
+	cleanup := noop
+	chart := p.Config.Chart
+	info, err := os.Stat(chart)
+	switch {
+	case err == nil && info.IsDir():
+		return noop, fmt.Errorf("Error: %s must be a packaged chart to be verified", chart)
+	case err == nil:
+		if p.Config.Verify {
+			if err := runCommand(doHelmVerify(chart)); err != nil {
+				return noop, fmt.Errorf("Error verifying chart %s: %v", chart, err)
+			}
+		}
+	default:
+		if chart, cleanup, err = fetchChart(p); err != nil {
+			return noop, fmt.Errorf("Error verifying chart %s: %v", p.Config.Chart, err)
+		}
+	}
+
+	if p.Config.ChartDigest != "" {
+		digest, err := fileDigest(chart)
+		if err != nil {
+			cleanup()
+			return noop, err
+		}
+		expected := p.Config.ChartDigest
+		if !strings.HasPrefix(expected, "sha256:") {
+			expected = "sha256:" + expected
+		}
+		if !strings.EqualFold(digest, expected) {
+			cleanup()
+			return noop, fmt.Errorf("Error: chart digest is %s, expected %s", digest, expected)
+		}
+	}
+
+	if p.Config.Debug {
+		log.Println("chart verified: " + chart)
+	}
+	p.Config.Chart = chart
+	return cleanup, nil
+}
@@ -0,0 +1,97 @@
+package plugin
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestVerifyChartFromRepo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helm-home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	HELM_HOME = dir
+
+	// the fake helm writes the chart into the --destination folder
+	calls, restore := fakeHelm(t, `[ "$1" = "fetch" ] && printf chart-data > "$4/app-1.0.0.tgz"
+exit 0`)
+	defer restore()
+
+	os.Setenv("PROD_VERIFY_KEYRING", "-----BEGIN PGP PUBLIC KEY BLOCK-----\nkey\n-----END PGP PUBLIC KEY BLOCK-----\n")
+	defer os.Unsetenv("PROD_VERIFY_KEYRING")
+
+	sum := sha256.Sum256([]byte("chart-data"))
+	plugin := &Plugin{
+		Config: Config{
+			Prefix:      "PROD",
+			Chart:       "stable/app",
+			Version:     "1.0.0",
+			Verify:      true,
+			ChartDigest: hex.EncodeToString(sum[:]),
+		},
+	}
+	cleanup, err := verifyChart(plugin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	if filepath.Base(plugin.Config.Chart) != "app-1.0.0.tgz" {
+		t.Errorf("the verified archive is not deployed, chart is %s", plugin.Config.Chart)
+	}
+	data, _ := ioutil.ReadFile(calls)
+	if !strings.HasPrefix(string(data), "fetch stable/app --destination ") || !strings.HasSuffix(string(data), " --version 1.0.0 --verify --keyring "+dir+"/pubring.gpg\n") {
+		t.Errorf("unexpected helm call %q", string(data))
+	}
+	if _, err := os.Stat(filepath.Join(dir, "pubring.gpg")); err != nil {
+		t.Errorf("keyring has not been written: %v", err)
+	}
+}
+
+func TestVerifyChartDigestMismatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "verify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	chart := filepath.Join(dir, "app-1.0.0.tgz")
+	ioutil.WriteFile(chart, []byte("tampered"), 0644)
+
+	plugin := &Plugin{
+		Config: Config{
+			Chart:       chart,
+			ChartDigest: "sha256:0000000000000000000000000000000000000000000000000000000000000000",
+		},
+	}
+	if _, err := verifyChart(plugin); err == nil {
+		t.Error("expected an error when the chart digest doesn't match")
+	}
+}
+
+func TestVerifyChartFailure(t *testing.T) {
+	_, restore := fakeHelm(t, "exit 1")
+	defer restore()
+
+	os.Setenv("VERIFY_KEYRING", "-----BEGIN PGP PUBLIC KEY BLOCK-----\n")
+	defer os.Unsetenv("VERIFY_KEYRING")
+	dir, err := ioutil.TempDir("", "helm-home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	HELM_HOME = dir
+
+	plugin := &Plugin{Config: Config{Chart: "stable/app", Verify: true}}
+	if _, err := verifyChart(plugin); err == nil {
+		t.Error("expected an error when helm can't verify the provenance")
+	}
+	if plugin.Config.Chart != "stable/app" {
+		t.Errorf("chart changed after a failed verification: %s", plugin.Config.Chart)
+	}
+}